@@ -0,0 +1,106 @@
+package srt
+
+import (
+	"encoding/hex"
+	"net"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/srt/wire"
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+	"golang.org/x/net/ipv4"
+)
+
+type (
+	// batchConn reads and writes many packets per syscall.
+	// ipv4.PacketConn and ipv6.PacketConn implement it.
+	batchConn interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+)
+
+// readBatch reads up to len(ms) packets at once and handles them.
+// Buffers are taken from the pool for empty messages.
+func (l *Listener) readBatch(ms []ipv4.Message) (err error) {
+	for i := range ms {
+		if ms[i].Buffers == nil {
+			ms[i].Buffers = make([][]byte, 1)
+		}
+
+		if ms[i].Buffers[0] == nil {
+			ms[i].Buffers[0] = l.pool.get(l.MaxTransmissonUnit)
+		}
+	}
+
+	n, err := l.batch.ReadBatch(ms, 0)
+	if err != nil {
+		return errors.Wrap(err, "read batch")
+	}
+
+	ts := low.Monotonic()
+
+	for i := 0; i < n; i++ {
+		m := &ms[i]
+
+		buf := wire.Packet(m.Buffers[0][:m.N])
+		m.Buffers[0] = nil
+
+		err = l.handlePacket(buf, m.Addr, ts)
+		if err != nil {
+			tlog.Printw("handle packet", "addr", m.Addr, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// putBatch returns unused message buffers to the pool.
+func (l *Listener) putBatch(ms []ipv4.Message) {
+	for _, m := range ms {
+		if m.Buffers != nil {
+			l.pool.put(m.Buffers[0])
+		}
+	}
+}
+
+// writeBatch sends packets to addr with as few syscalls as possible.
+func (s sender) writeBatch(ps []wire.DataPacket, addr net.Addr) (err error) {
+	if s.b == nil {
+		for _, p := range ps {
+			_, err = s.WriteTo(p, addr)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ms := make([]ipv4.Message, len(ps))
+	bufs := make([][]byte, len(ps))
+
+	for i, p := range ps {
+		bufs[i] = p
+
+		ms[i].Buffers = bufs[i : i+1]
+		ms[i].Addr = addr
+	}
+
+	for len(ms) != 0 {
+		n, err := s.b.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+
+		ms = ms[n:]
+	}
+
+	if tlog.If("raw") {
+		for _, p := range ps {
+			tlog.Printf("packet to   %v (batch)\n%s", addr, hex.Dump(p))
+		}
+	}
+
+	return nil
+}
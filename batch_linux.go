@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package srt
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// newBatchConn returns batch I/O layer for UDP sockets or nil if it's not supported.
+func newBatchConn(p net.PacketConn) batchConn {
+	u, ok := p.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+
+	if a, ok := u.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return ipv4.NewPacketConn(u)
+	}
+
+	return ipv6.NewPacketConn(u)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package srt
+
+import "net"
+
+// newBatchConn returns nil as recvmmsg and sendmmsg are Linux only.
+func newBatchConn(p net.PacketConn) batchConn {
+	return nil
+}
@@ -0,0 +1,176 @@
+package srt
+
+import "time"
+
+type (
+	// liveCC is live mode congestion control.
+	// It paces data packets to keep the sending rate under the bandwidth limit
+	// and lets retransmissions use only the overhead part of it.
+	// Zero value is disabled and doesn't limit anything, it's used outside of live mode.
+	liveCC struct {
+		live bool // enabled
+
+		maxbw    int64 // bytes per second, RelativeBW or InfiniteBW
+		inputbw  int64 // for RelativeBW, 0 is estimated
+		overhead int   // percent
+
+		size   int   // average packet size on the wire
+		period int64 // between packets
+		next   int64 // the next packet send time
+
+		budget   int64 // bytes allowed to retransmit
+		refilled int64 // last budget refill time
+
+		in      int64 // input bytes since inStart
+		inStart int64
+		inRate  int64 // estimated input bytes per second
+	}
+)
+
+// Listener.MaxBW special values. They are the same as libsrt SRTO_MAXBW ones.
+const (
+	// RelativeBW limits bandwidth by InputBW plus OverheadBW percent.
+	RelativeBW = 0
+
+	// InfiniteBW is the libsrt default which is 1Gbps in live mode.
+	InfiniteBW = -1
+)
+
+const (
+	infiniteBWRate = 1_000_000_000 / 8
+	ipUDPHeaders   = 20 + 8
+
+	inputRateInterval = time.Second
+
+	// pacingSlack is how much the sender may catch up after being late.
+	pacingSlack = time.Millisecond
+)
+
+// input accounts bytes written by the user to estimate the input rate.
+func (cc *liveCC) input(size int, now int64) {
+	if !cc.live || cc.maxbw != RelativeBW || cc.inputbw != 0 {
+		return
+	}
+
+	if cc.inStart == 0 {
+		cc.inStart = now
+	}
+
+	cc.in += int64(size)
+
+	d := now - cc.inStart
+	if d < int64(inputRateInterval) {
+		return
+	}
+
+	cc.inRate = int64(ewma(int(cc.inRate), int(cc.in*int64(time.Second)/d)))
+	cc.in = 0
+	cc.inStart = now
+
+	cc.update()
+}
+
+// bw returns the sending rate limit in bytes per second or 0 if unlimited.
+func (cc *liveCC) bw() int64 {
+	switch {
+	case cc.maxbw == InfiniteBW:
+		return infiniteBWRate
+	case cc.maxbw != RelativeBW:
+		return cc.maxbw
+	}
+
+	in := cc.inputbw
+	if in == 0 {
+		in = cc.inRate
+	}
+
+	return in * int64(100+cc.overhead) / 100
+}
+
+func (cc *liveCC) update() {
+	bw := cc.bw()
+	if !cc.live || bw <= 0 || cc.size == 0 {
+		cc.period = 0
+		return
+	}
+
+	cc.period = int64(cc.size) * int64(time.Second) / bw
+}
+
+// sent accounts original data packet of size bytes.
+func (cc *liveCC) sent(size int) {
+	size += ipUDPHeaders
+
+	cc.size = ewma(cc.size, size)
+	cc.update()
+}
+
+// refill adds the overhead part of bandwidth passed since the last refill to the budget.
+// It's time based so losses are recovered even if the user stopped writing.
+func (cc *liveCC) refill(now int64) {
+	rate := cc.bw() * int64(cc.overhead) / 100
+
+	if d := now - cc.refilled; cc.refilled != 0 && d > 0 {
+		if d > int64(time.Second) {
+			d = int64(time.Second)
+		}
+
+		cc.budget += d * rate / int64(time.Second)
+	}
+
+	cc.refilled = now
+
+	if cc.budget > rate {
+		cc.budget = rate
+	}
+}
+
+// delay returns how long to wait before sending the next packet.
+func (cc *liveCC) delay(now int64) int64 {
+	if cc.period == 0 {
+		return 0
+	}
+
+	return cc.next - now
+}
+
+// due reports whether the next packet may be sent now.
+func (cc *liveCC) due(now int64) bool {
+	return cc.delay(now) <= 0
+}
+
+// reserve takes send time for n packets.
+func (cc *liveCC) reserve(now int64, n int) {
+	if cc.period == 0 {
+		return
+	}
+
+	cc.refill(now)
+
+	if min := now - int64(pacingSlack); cc.next < min {
+		cc.next = min
+	}
+
+	cc.next += int64(n) * cc.period
+}
+
+// rexmit reports whether packet of size bytes fits the overhead
+// and takes send time for it if so.
+func (cc *liveCC) rexmit(size int, now int64) bool {
+	if cc.period == 0 {
+		return true
+	}
+
+	size += ipUDPHeaders
+
+	cc.refill(now)
+
+	if cc.budget < int64(size) {
+		return false
+	}
+
+	cc.budget -= int64(size)
+	cc.reserve(now, 1)
+
+	return true
+}
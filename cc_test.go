@@ -0,0 +1,93 @@
+package srt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveCCPacing(t *testing.T) {
+	cc := liveCC{live: true}
+
+	cc.sent(1000)
+	cc.reserve(0, 1)
+	assert.EqualValues(t, 0, cc.delay(0), "no input estimate")
+
+	cc = liveCC{live: true, maxbw: InfiniteBW}
+
+	cc.sent(1000 - ipUDPHeaders)
+	assert.EqualValues(t, 125_000_000, cc.bw(), "libsrt live mode default")
+	assert.EqualValues(t, 8*time.Microsecond, cc.period)
+
+	cc = liveCC{
+		live:     true,
+		maxbw:    1_000_000,
+		overhead: 25,
+	}
+
+	now := int64(time.Second)
+
+	cc.sent(1000 - ipUDPHeaders)
+	assert.EqualValues(t, time.Millisecond, cc.period)
+
+	cc.reserve(now, 1)
+	assert.EqualValues(t, time.Millisecond-pacingSlack, cc.delay(now), "caught up after idle")
+
+	now += int64(time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		cc.sent(1000 - ipUDPHeaders)
+	}
+
+	cc.reserve(now, 4)
+	assert.EqualValues(t, 3*time.Millisecond, cc.delay(now))
+	assert.EqualValues(t, 250, cc.budget, "overhead of 1ms")
+
+	now += int64(4 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, cc.rexmit(300-ipUDPHeaders, now), "rexmit %d", i)
+	}
+
+	assert.False(t, cc.rexmit(300-ipUDPHeaders, now), "over the overhead")
+	assert.EqualValues(t, 3*time.Millisecond, cc.delay(now), "retransmissions take send time")
+
+	now += int64(time.Minute)
+
+	assert.True(t, cc.rexmit(300-ipUDPHeaders, now), "refilled while idle")
+	assert.EqualValues(t, 250_000-300, cc.budget, "capped at one second")
+}
+
+func TestLiveCCRelative(t *testing.T) {
+	cc := liveCC{
+		live:     true,
+		maxbw:    RelativeBW,
+		inputbw:  800_000,
+		overhead: 25,
+	}
+
+	cc.sent(1000 - ipUDPHeaders)
+	assert.EqualValues(t, 1_000_000, cc.bw())
+	assert.EqualValues(t, time.Millisecond, cc.period)
+
+	cc = liveCC{
+		live:     true,
+		maxbw:    RelativeBW,
+		overhead: 25,
+	}
+
+	cc.sent(1000 - ipUDPHeaders)
+	assert.EqualValues(t, 0, cc.period, "no estimate yet")
+
+	now := int64(time.Second)
+
+	for i := 0; i < 10; i++ {
+		cc.input(80_000, now+int64(i)*int64(inputRateInterval)/10)
+	}
+
+	cc.input(0, now+int64(inputRateInterval))
+
+	assert.EqualValues(t, 800_000, cc.inRate)
+	assert.EqualValues(t, time.Millisecond, cc.period)
+}
@@ -44,6 +44,8 @@ func main() {
 				Flags: []*cli.Flag{
 					cli.NewFlag("addr", "localhost:8090", "addr"),
 					cli.NewFlag("file", "go.mod", "file name"),
+					cli.NewFlag("streamid", "", "stream id"),
+					cli.NewFlag("passphrase", "", "encryption passphrase"),
 				},
 			}, {
 				Name:   "recv",
@@ -51,6 +53,7 @@ func main() {
 				Flags: []*cli.Flag{
 					cli.NewFlag("addr", "localhost:8090", "addr"),
 					cli.NewFlag("file", "/dev/tty", "file name"),
+					cli.NewFlag("passphrase", "", "encryption passphrase"),
 				},
 			}},
 		}, {
@@ -100,19 +103,13 @@ func before(c *cli.Command) (err error) {
 }
 
 func filerecv(c *cli.Command) (err error) {
-	p, err := net.ListenPacket("udp", c.String("addr"))
+	l, err := srt.Listen("udp", c.String("addr"))
 	if err != nil {
-		return errors.Wrap(err, "listen udp")
+		return errors.Wrap(err, "listen")
 	}
 
-	defer func() {
-		e := p.Close()
-		if err == nil {
-			err = errors.Wrap(e, "close udp")
-		}
-	}()
+	l.Passphrase = c.String("passphrase")
 
-	l := srt.New(p)
 	defer func() {
 		e := l.Close()
 		if err == nil {
@@ -134,7 +131,7 @@ func filerecv(c *cli.Command) (err error) {
 		}
 	}()
 
-	tlog.Printw("accepted", "addr", s.RemoteAddr())
+	tlog.Printw("accepted", "addr", s.RemoteAddr(), "streamid", s.(*srt.Conn).StreamID())
 
 	buf := make([]byte, 2000)
 
@@ -180,10 +177,11 @@ func filesend(c *cli.Command) (err error) {
 	}()
 
 	l := srt.New(p)
+	l.Passphrase = c.String("passphrase")
 
 	tlog.Printw("connecting", "addr", addr)
 
-	s, err := l.Connect(context.Background(), addr)
+	s, err := l.ConnectStreamID(context.Background(), addr, c.String("streamid"))
 	if err != nil {
 		return errors.Wrap(err, "connect")
 	}
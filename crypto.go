@@ -0,0 +1,407 @@
+package srt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/nikandfor/errors"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/nikandfor/srt/wire"
+)
+
+type (
+	crypter struct {
+		cipher int
+		klen   int
+
+		salt [16]byte
+
+		keys   [2][]byte // even, odd
+		blocks [2]cipher.Block
+		aeads  [2]cipher.AEAD // GCM mode
+
+		odd bool // send key
+
+		cnt    int  // packets sent with the current key
+		retire bool // previous key is to be decommissioned
+	}
+)
+
+const (
+	pbkdf2Iter    = 2048
+	pbkdf2SaltLen = 8
+
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+var (
+	ErrBadSecret = errors.New("bad secret")
+	ErrNoKey     = errors.New("no key")
+	ErrAuth      = errors.New("message authentication failed")
+
+	keyWrapIV = [8]byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+)
+
+func newCrypter(mode, klen int) (c *crypter, err error) {
+	c = &crypter{
+		cipher: mode,
+		klen:   klen,
+	}
+
+	_, err = rand.Read(c.salt[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "salt")
+	}
+
+	err = c.newKey(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *crypter) newKey(odd bool) (err error) {
+	key := make([]byte, c.klen)
+
+	_, err = rand.Read(key)
+	if err != nil {
+		return errors.Wrap(err, "key")
+	}
+
+	return c.setKey(odd, key)
+}
+
+// rotate is called for each sent packet.
+// It returns key slots to announce to the peer if any.
+// Each side rotates keys for the direction it sends.
+func (c *crypter) rotate(refresh, pre int) (keys int, err error) {
+	if refresh < 4 {
+		return 0, nil
+	}
+
+	if pre*2 >= refresh {
+		pre = refresh / 4
+	}
+
+	c.cnt++
+
+	switch {
+	case c.cnt == refresh-pre:
+		err = c.newKey(!c.odd)
+		if err != nil {
+			return 0, err
+		}
+
+		return wire.KeyEven | wire.KeyOdd, nil
+	case c.cnt >= refresh:
+		c.odd = !c.odd
+		c.cnt = 0
+		c.retire = true
+	case c.retire && c.cnt == pre:
+		c.retire = false
+
+		i := slot(!c.odd)
+		c.keys[i], c.blocks[i], c.aeads[i] = nil, nil, nil
+
+		return keySlot(c.odd), nil
+	}
+
+	return 0, nil
+}
+
+// clone makes a copy for the other direction.
+// Both start with the same keys and rotate them independently.
+func (c *crypter) clone() *crypter {
+	x := *c
+
+	return &x
+}
+
+func parseKeyMaterial(km wire.KeyMaterial, pass string) (c *crypter, err error) {
+	c = &crypter{}
+
+	err = c.update(km, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// update installs keys from key material.
+func (c *crypter) update(km wire.KeyMaterial, pass string) (err error) {
+	if !km.Valid() || km.SaltLen() != len(c.salt) {
+		return errors.New("bad key material")
+	}
+
+	switch km.Cipher() {
+	case wire.CipherCTR, wire.CipherGCM:
+	default:
+		return errors.New("unsupported cipher: %d", km.Cipher())
+	}
+
+	klen := km.KeyLen()
+
+	if c.klen != 0 && (c.klen != klen || c.cipher != km.Cipher()) {
+		return errors.New("key material mismatch")
+	}
+
+	c.cipher = km.Cipher()
+	c.klen = klen
+	copy(c.salt[:], km.Salt())
+
+	keys, err := keyUnwrap(c.kek(pass), km.Wrapped())
+	if err != nil {
+		return err
+	}
+
+	for _, odd := range []bool{false, true} {
+		if km.Keys()&keySlot(odd) == 0 {
+			continue
+		}
+
+		err = c.setKey(odd, keys[:klen])
+		if err != nil {
+			return err
+		}
+
+		keys = keys[klen:]
+	}
+
+	return nil
+}
+
+// keyMaterial makes KM message with keys selected.
+func (c *crypter) keyMaterial(pass string, keys int) (km wire.KeyMaterial, err error) {
+	var plain []byte
+
+	if keys&wire.KeyEven != 0 {
+		plain = append(plain, c.keys[0]...)
+	}
+
+	if keys&wire.KeyOdd != 0 {
+		plain = append(plain, c.keys[1]...)
+	}
+
+	wrapped, err := keyWrap(c.kek(pass), plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.MakeKeyMaterial(c.cipher, keys, c.salt[:], wrapped), nil
+}
+
+func (c *crypter) setKey(odd bool, key []byte) (err error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrap(err, "cipher")
+	}
+
+	i := slot(odd)
+
+	c.keys[i] = append([]byte{}, key...)
+	c.blocks[i] = b
+
+	if c.cipher == wire.CipherGCM {
+		c.aeads[i], err = cipher.NewGCM(b)
+		if err != nil {
+			return errors.Wrap(err, "gcm")
+		}
+	}
+
+	return nil
+}
+
+// overhead is the number of bytes added to payload.
+func (c *crypter) overhead() int {
+	if c.cipher == wire.CipherGCM {
+		return gcmTagSize
+	}
+
+	return 0
+}
+
+func (c *crypter) kek(pass string) []byte {
+	return pbkdf2.Key([]byte(pass), c.salt[len(c.salt)-pbkdf2SaltLen:], pbkdf2Iter, c.klen, sha1.New)
+}
+
+// encrypt encrypts payload in place.
+// In GCM mode the last overhead() bytes of payload are reserved for the tag.
+func (c *crypter) encrypt(p wire.DataPacket) {
+	p.SetEncryption(true, c.odd)
+
+	if c.cipher == wire.CipherGCM {
+		c.seal(c.aeads[slot(c.odd)], p)
+		return
+	}
+
+	c.xor(c.blocks[slot(c.odd)], p)
+}
+
+// decrypt decrypts payload in place and returns packet without the tag if any.
+func (c *crypter) decrypt(p wire.DataPacket) (_ wire.DataPacket, err error) {
+	i := slot(p.EncOdd())
+
+	if c.cipher == wire.CipherGCM {
+		if c.aeads[i] == nil {
+			return nil, ErrNoKey
+		}
+
+		return c.open(c.aeads[i], p)
+	}
+
+	if c.blocks[i] == nil {
+		return nil, ErrNoKey
+	}
+
+	c.xor(c.blocks[i], p)
+
+	return p, nil
+}
+
+func (c *crypter) seal(a cipher.AEAD, p wire.DataPacket) {
+	var aad [8]byte
+
+	nonce := c.gcmNonce(p, &aad)
+
+	data := p.Data()
+	data = data[:len(data)-gcmTagSize]
+
+	a.Seal(data[:0], nonce[:], data, aad[:])
+}
+
+func (c *crypter) open(a cipher.AEAD, p wire.DataPacket) (_ wire.DataPacket, err error) {
+	var aad [8]byte
+
+	nonce := c.gcmNonce(p, &aad)
+
+	data, err := a.Open(p.Data()[:0], nonce[:], p.Data(), aad[:])
+	if err != nil {
+		return nil, ErrAuth
+	}
+
+	return p[:len(p)-len(p.Data())+len(data)], nil
+}
+
+// gcmNonce fills additional data with seq and msg fields except for
+// retransmission flag which is changed after encryption.
+func (c *crypter) gcmNonce(p wire.DataPacket, aad *[8]byte) (nonce [gcmNonceSize]byte) {
+	copy(aad[:], p)
+	aad[4] &^= 0b0000_0100
+
+	binary.BigEndian.PutUint32(nonce[8:], p.Seq())
+
+	for i := range nonce {
+		nonce[i] ^= c.salt[i]
+	}
+
+	return nonce
+}
+
+func (c *crypter) xor(b cipher.Block, p wire.DataPacket) {
+	var iv [aes.BlockSize]byte
+
+	binary.BigEndian.PutUint32(iv[10:], p.Seq())
+
+	for i := 0; i < 14; i++ {
+		iv[i] ^= c.salt[i]
+	}
+
+	cipher.NewCTR(b, iv[:]).XORKeyStream(p.Data(), p.Data())
+}
+
+func slot(odd bool) int {
+	if odd {
+		return 1
+	}
+
+	return 0
+}
+
+func keySlot(odd bool) int {
+	if odd {
+		return wire.KeyOdd
+	}
+
+	return wire.KeyEven
+}
+
+// keyWrap is RFC 3394 AES key wrap.
+func keyWrap(kek, plain []byte) (_ []byte, err error) {
+	b, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errors.Wrap(err, "kek")
+	}
+
+	if len(plain)%8 != 0 || len(plain) < 16 {
+		return nil, errors.New("bad key size: %d", len(plain))
+	}
+
+	n := len(plain) / 8
+
+	r := make([]byte, 8+len(plain))
+	copy(r, keyWrapIV[:])
+	copy(r[8:], plain)
+
+	var buf [16]byte
+
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], r[:8])
+			copy(buf[8:], r[8*i:])
+
+			b.Encrypt(buf[:], buf[:])
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(r, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[8*i:], buf[8:])
+		}
+	}
+
+	return r, nil
+}
+
+// keyUnwrap is RFC 3394 AES key unwrap.
+func keyUnwrap(kek, wrapped []byte) (_ []byte, err error) {
+	b, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errors.Wrap(err, "kek")
+	}
+
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("bad wrapped key size: %d", len(wrapped))
+	}
+
+	n := len(wrapped)/8 - 1
+
+	r := make([]byte, len(wrapped))
+	copy(r, wrapped)
+
+	var buf [16]byte
+
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(r)^t)
+			copy(buf[8:], r[8*i:])
+
+			b.Decrypt(buf[:], buf[:])
+
+			copy(r[:8], buf[:8])
+			copy(r[8*i:], buf[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(r[:8], keyWrapIV[:]) != 1 {
+		return nil, ErrBadSecret
+	}
+
+	return r[8:], nil
+}
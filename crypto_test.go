@@ -0,0 +1,197 @@
+package srt
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/srt/wire"
+)
+
+func TestKeyWrap(t *testing.T) {
+	// RFC 3394 4.1
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+	exp, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+
+	w, err := keyWrap(kek, key)
+	require.NoError(t, err)
+	assert.Equal(t, exp, w)
+
+	k, err := keyUnwrap(kek, w)
+	require.NoError(t, err)
+	assert.Equal(t, key, k)
+
+	w[3]++
+
+	_, err = keyUnwrap(kek, w)
+	assert.True(t, errors.Is(err, ErrBadSecret))
+}
+
+func TestCrypterKeyMaterial(t *testing.T) {
+	c, err := newCrypter(wire.CipherCTR, 24)
+	require.NoError(t, err)
+
+	km, err := c.keyMaterial("passphrase", wire.KeyEven)
+	require.NoError(t, err)
+	require.True(t, km.Valid())
+
+	assert.Equal(t, wire.KeyEven, km.Keys())
+	assert.Equal(t, 24, km.KeyLen())
+
+	_, err = parseKeyMaterial(km, "wrong")
+	assert.True(t, errors.Is(err, ErrBadSecret))
+
+	r, err := parseKeyMaterial(km, "passphrase")
+	require.NoError(t, err)
+
+	p := make(wire.DataPacket, 16+100)
+	p.SetSeq(0x1234)
+	copy(p.Data(), "plain text payload")
+
+	c.encrypt(p)
+
+	assert.True(t, p.Encrypted())
+	assert.False(t, p.EncOdd())
+	assert.NotEqual(t, "plain text payload", string(p.Data()[:18]))
+
+	_, err = r.decrypt(p)
+	require.NoError(t, err)
+
+	assert.Equal(t, "plain text payload", string(p.Data()[:18]))
+}
+
+func TestCrypterRotate(t *testing.T) {
+	c, err := newCrypter(wire.CipherCTR, 16)
+	require.NoError(t, err)
+
+	km, err := c.keyMaterial("pass", wire.KeyEven)
+	require.NoError(t, err)
+
+	r, err := parseKeyMaterial(km, "pass")
+	require.NoError(t, err)
+
+	var announced []int
+
+	for i := 1; i <= 25; i++ {
+		p := make(wire.DataPacket, 16+4)
+		p.SetSeq(uint32(i))
+		copy(p.Data(), "data")
+
+		c.encrypt(p)
+
+		assert.Equal(t, i > 10 && i <= 20, p.EncOdd(), "packet %d", i)
+
+		keys, err := c.rotate(10, 2)
+		require.NoError(t, err)
+
+		if keys != 0 {
+			announced = append(announced, i)
+
+			km, err := c.keyMaterial("pass", keys)
+			require.NoError(t, err)
+
+			err = r.update(km, "pass")
+			require.NoError(t, err)
+		}
+
+		_, err = r.decrypt(p)
+		require.NoError(t, err, "packet %d", i)
+		assert.Equal(t, "data", string(p.Data()), "packet %d", i)
+	}
+
+	assert.Equal(t, []int{8, 12, 18, 22}, announced)
+	assert.Nil(t, c.blocks[1], "odd key retired")
+}
+
+func TestCrypterRotateBothWays(t *testing.T) {
+	c, err := newCrypter(wire.CipherCTR, 16)
+	require.NoError(t, err)
+
+	km, err := c.keyMaterial("pass", wire.KeyEven)
+	require.NoError(t, err)
+
+	r, err := parseKeyMaterial(km, "pass")
+	require.NoError(t, err)
+
+	crx, rtx := c.clone(), r.clone()
+
+	for i := 1; i <= 25; i++ {
+		for _, x := range []struct {
+			tx, rx  *crypter
+			refresh int
+		}{
+			{c, r, 10},
+			{rtx, crx, 7},
+		} {
+			p := make(wire.DataPacket, 16+4)
+			p.SetSeq(uint32(i))
+			copy(p.Data(), "data")
+
+			x.tx.encrypt(p)
+
+			keys, err := x.tx.rotate(x.refresh, 2)
+			require.NoError(t, err)
+
+			if keys != 0 {
+				km, err := x.tx.keyMaterial("pass", keys)
+				require.NoError(t, err)
+
+				err = x.rx.update(km, "pass")
+				require.NoError(t, err)
+			}
+
+			_, err = x.rx.decrypt(p)
+			require.NoError(t, err, "packet %d refresh %d", i, x.refresh)
+			assert.Equal(t, "data", string(p.Data()), "packet %d refresh %d", i, x.refresh)
+		}
+	}
+
+	assert.True(t, c.odd != rtx.odd, "rotated independently")
+}
+
+func TestCrypterGCM(t *testing.T) {
+	c, err := newCrypter(wire.CipherGCM, 16)
+	require.NoError(t, err)
+
+	km, err := c.keyMaterial("pass", wire.KeyEven)
+	require.NoError(t, err)
+
+	assert.Equal(t, wire.CipherGCM, km.Cipher())
+	assert.Equal(t, 1, km.Auth())
+
+	r, err := parseKeyMaterial(km, "pass")
+	require.NoError(t, err)
+
+	msg := "authenticated payload"
+
+	p := make(wire.DataPacket, 16+len(msg)+c.overhead())
+	p.SetSeq(0x4321)
+	p.SetSingle(true)
+	copy(p.Data(), msg)
+
+	c.encrypt(p)
+
+	p.SetRetransmitted(true)
+
+	q := append(wire.DataPacket{}, p...)
+
+	d, err := r.decrypt(q)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(d.Data()))
+
+	q = append(q[:0], p...)
+	q.Data()[3] ^= 1
+
+	_, err = r.decrypt(q)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	q = append(q[:0], p...)
+	q.SetSeq(0x4322)
+
+	_, err = r.decrypt(q)
+	assert.True(t, errors.Is(err, ErrAuth))
+}
@@ -6,5 +6,7 @@ require (
 	github.com/nikandfor/cli v0.0.0-20210105003942-afe14413f747
 	github.com/nikandfor/errors v0.4.0
 	github.com/nikandfor/tlog v0.11.0
-	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
 )
@@ -2,31 +2,93 @@ package srt
 
 import (
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/nikandfor/errors"
+	"github.com/nikandfor/srt/seqno"
 	"github.com/nikandfor/srt/wire"
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/low"
+	"golang.org/x/net/ipv4"
 )
 
 type (
 	Listener struct {
-		p net.PacketConn
-
+		p   net.PacketConn
+		own bool // p is closed with the listener
+
+		// Passphrase enables payload encryption.
+		// Encryption selects key length, AES128 is used by default.
+		// CryptoMode is wire.CipherCTR or wire.CipherGCM.
+		// Caller proposes its mode, listener accepts any if CryptoMode is zero.
+		Passphrase string
 		Encryption int
+		CryptoMode int
+
+		// KeyRefreshRate is the number of packets sent with one key before switching to the other one.
+		// The new key is announced KeyPreannounce packets before the switch
+		// and the old one is decommissioned KeyPreannounce packets after.
+		// Each side rotates keys for the data it sends.
+		KeyRefreshRate int
+		KeyPreannounce int
 
 		MaxTransmissonUnit int
 		MaxFlowWindow      int
 
-		//	mu sync.Mutex
+		// Latency enables timestamp-based packet delivery (TSBPD) if not zero.
+		Latency time.Duration
+
+		// TooLatePacketDrop skips packets which can't be delivered in time.
+		// Used in conjunction with Latency.
+		TooLatePacketDrop bool
+
+		// Linger is how long Conn.Close waits for sent data to be acknowledged.
+		// Zero closes immediately.
+		Linger time.Duration
+
+		// PeerIdleTimeout closes the connection if nothing came from the peer for that long.
+		// Zero disables it.
+		PeerIdleTimeout time.Duration
+
+		// AcceptFilter is called before the connection is accepted.
+		// Error rejects the caller with *RejectError reason or wire.RejPeer otherwise.
+		AcceptFilter func(req *ConnRequest) error
+
+		// Congestion is the congestion control type proposed to the peer, "live" (default) or "file".
+		// Sending is paced in live mode only.
+		Congestion string
+
+		// MaxBW limits the live mode sending rate including retransmissions in bytes per second.
+		// Values follow libsrt SRTO_MAXBW: InfiniteBW (default) is 1Gbps
+		// and RelativeBW (zero) sets it to InputBW plus OverheadBW percent.
+		// InputBW is estimated from Conn.Write calls if zero.
+		// Retransmissions may use no more than OverheadBW percent of the bandwidth.
+		MaxBW      int64
+		InputBW    int64
+		OverheadBW int
+
+		secret [16]byte // cookie key
+
+		batch     batchConn // nil if not supported
+		batchSize int32     // atomic, see SetBatchSize
+
+		pool packetPool // receive buffers sized by MaxTransmissonUnit
+
+		mu sync.Mutex
 
 		socks map[sockkey]*Conn
+		peers map[sockkey]*Conn // by peer socket id
 		conng map[uint32]*connreq
+		rdv   map[sockkey]*connreq
 
 		rand *rand.Rand
 
@@ -34,7 +96,26 @@ type (
 
 		acceptc chan *Conn
 
-		stopc chan struct{}
+		stopc    chan struct{}
+		stopOnce sync.Once
+		donec    chan struct{} // read loop is finished
+	}
+
+	// ConnRequest is the caller handshake data.
+	ConnRequest struct {
+		Addr     net.Addr
+		StreamID string
+
+		Version    int    // handshake version
+		SRTVersion uint32 // 0x010402 for 1.4.2
+
+		Encryption int // wire.AES128, wire.AES192, wire.AES256 or wire.NoEncryption
+		CryptoMode int
+
+		Latency time.Duration
+
+		MaxTransmissonUnit int
+		MaxFlowWindow      int
 	}
 
 	sockkey struct {
@@ -45,46 +126,126 @@ type (
 
 	sender struct {
 		net.PacketConn
+
+		b batchConn // nil if batching is disabled
 	}
 
 	conndata struct {
 		tp uint32
 
+		ver    uint32
+		srtver uint32
+
 		lid uint32
 		rid uint32
 
 		lseq uint32
 		rseq uint32
+
+		mtu    int
+		window int
+
+		pflags uint32 // peer handshake extension flags
+
+		rlatency int64
+		slatency int64
+
+		kmreq  wire.KeyMaterial
+		kmrsp  wire.KeyMaterial
+		crypto *crypter
+
+		streamid   string
+		congestion string
 	}
 
 	connreq struct {
-		id   uint32
-		errc chan error
-		c    *Conn
+		id       uint32
+		seq      uint32
+		streamid string
+		crypto   *crypter
+		errc     chan error
+		c        *Conn
+
+		// rendezvous
+		cookie    uint32
+		peer      uint32
+		resolved  bool
+		initiator bool
+
+		mu   sync.Mutex
+		last wire.Handshake // resent periodically
 	}
 
 	testAddr string
 )
 
+var errBadCookie = errors.New("bad cookie")
+
 func newListener(p net.PacketConn) (l *Listener) {
-	return &Listener{
+	l = &Listener{
 		p: p,
 
 		MaxTransmissonUnit: 1500,
 		MaxFlowWindow:      0x2000,
 
+		KeyRefreshRate: 1 << 24,
+		KeyPreannounce: 1 << 12,
+
+		PeerIdleTimeout: 5 * time.Second,
+
+		MaxBW:      InfiniteBW,
+		OverheadBW: 25,
+
 		socks:   make(map[sockkey]*Conn),
+		peers:   make(map[sockkey]*Conn),
 		conng:   make(map[uint32]*connreq),
+		rdv:     make(map[sockkey]*connreq),
 		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
 		acceptc: make(chan *Conn, 2),
 		stopc:   make(chan struct{}),
+
+		batch: newBatchConn(p),
+	}
+
+	_, err := crand.Read(l.secret[:])
+	if err != nil {
+		panic(err)
 	}
+
+	return l
 }
 
+// New creates Listener on top of p.
+// p is not closed with the Listener.
 func New(p net.PacketConn) (l *Listener) {
 	l = newListener(p)
 
+	l.start()
+
+	return l
+}
+
+// Listen creates Listener on a new PacketConn which is owned and closed by the Listener.
+func Listen(network, addr string) (l *Listener, err error) {
+	p, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen packet")
+	}
+
+	l = newListener(p)
+	l.own = true
+
+	l.start()
+
+	return l, nil
+}
+
+func (l *Listener) start() {
+	l.donec = make(chan struct{})
+
 	go func() {
+		defer close(l.donec)
+
 		for {
 			err := l.run()
 
@@ -94,38 +255,142 @@ func New(p net.PacketConn) (l *Listener) {
 			default:
 			}
 
+			if errors.Is(err, net.ErrClosed) {
+				tlog.Printw("packet conn closed", "err", err)
+				return
+			}
+
 			tlog.Printw("run", "err", err)
 		}
 	}()
+}
 
-	return l
+// SetBatchSize sets the number of packets read or written per syscall.
+// It's used with UDP sockets on Linux if greater than 1.
+// It may be called on the running Listener, new connections use the new value.
+func (l *Listener) SetBatchSize(n int) {
+	atomic.StoreInt32(&l.batchSize, int32(n))
+}
+
+// batchPackets returns the batch size or 0 if batching is not used.
+func (l *Listener) batchPackets() int {
+	if l.batch == nil {
+		return 0
+	}
+
+	return int(atomic.LoadInt32(&l.batchSize))
 }
 
 func (l *Listener) Addr() net.Addr {
 	return l.p.LocalAddr()
 }
 
+// OwnsPacketConn reports whether the PacketConn is closed with the Listener.
+func (l *Listener) OwnsPacketConn() bool {
+	return l.own
+}
+
+// Close shuts down all the connections, fails pending Accept, Connect and Rendezvous calls
+// and stops the read loop.
+// PacketConn is closed if it's owned by the Listener.
 func (l *Listener) Close() (err error) {
+	err = net.ErrClosed
+
+	l.stopOnce.Do(func() {
+		err = l.close()
+	})
+
+	return err
+}
+
+func (l *Listener) close() (err error) {
 	close(l.stopc)
 
-	return
+	l.mu.Lock()
+
+	conns := make([]*Conn, 0, len(l.socks))
+	for _, c := range l.socks {
+		conns = append(conns, c)
+	}
+
+	l.mu.Unlock()
+
+	for _, c := range conns {
+		e := c.close(0)
+		if e != nil {
+			tlog.Printw("close connection", "local_sid", tlog.Hex(c.localid), "err", e)
+		}
+	}
+
+	if l.own {
+		err = l.p.Close()
+	} else {
+		err = l.p.SetReadDeadline(time.Now())
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "stop reading")
+	}
+
+	if l.donec != nil {
+		<-l.donec
+	}
+
+	if !l.own {
+		err = l.p.SetReadDeadline(time.Time{})
+		if err != nil {
+			return errors.Wrap(err, "reset read deadline")
+		}
+	}
+
+	return nil
 }
 
 func (l *Listener) Connect(ctx context.Context, addr net.Addr) (_ *Conn, err error) {
+	return l.ConnectStreamID(ctx, addr, "")
+}
+
+// ConnectStreamID connects to addr requesting the stream.
+// Listener side gets it with Conn.StreamID.
+func (l *Listener) ConnectStreamID(ctx context.Context, addr net.Addr, streamid string) (_ *Conn, err error) {
+	if len(streamid) > maxStreamIDLen {
+		return nil, errors.New("stream id is too long: %d", len(streamid))
+	}
+
 	req := connreq{
-		id:   uint32(l.rand.Int31()),
-		errc: make(chan error, 1),
+		id:       l.random(),
+		seq:      l.random(),
+		streamid: streamid,
+		errc:     make(chan error, 1),
+	}
+
+	if l.Passphrase != "" {
+		req.crypto, err = newCrypter(l.cryptoMode(), l.keyLen())
+		if err != nil {
+			return nil, errors.Wrap(err, "init encryption")
+		}
 	}
 
+	l.mu.Lock()
 	l.conng[req.id] = &req
+	l.mu.Unlock()
 
 	defer func() {
+		l.mu.Lock()
 		delete(l.conng, req.id)
+		l.mu.Unlock()
 	}()
 
-	tlog.Printw("connect as", "streamid", tlog.Hex(req.id))
+	select {
+	case <-l.stopc:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	tlog.Printw("connect as", "socket_id", tlog.Hex(req.id), "streamid", streamid)
 
 	p := l.newHandshake(wire.Induction, req.id)
+	p.SetSeq(req.seq)
 
 	_, err = l.WriteTo(p, addr)
 	if err != nil {
@@ -136,6 +401,8 @@ func (l *Listener) Connect(ctx context.Context, addr net.Addr) (_ *Conn, err err
 	case err = <-req.errc:
 	case <-ctx.Done():
 		err = ctx.Err()
+	case <-l.stopc:
+		err = net.ErrClosed
 	}
 
 	if err != nil {
@@ -146,8 +413,24 @@ func (l *Listener) Connect(ctx context.Context, addr net.Addr) (_ *Conn, err err
 }
 
 func (l *Listener) run() (err error) {
+	var ms []ipv4.Message
+
+	defer func() {
+		l.putBatch(ms)
+	}()
+
 	for {
-		err = l.readPacket()
+		if n := l.batchPackets(); n > 1 {
+			if len(ms) != n {
+				l.putBatch(ms)
+				ms = make([]ipv4.Message, n)
+			}
+
+			err = l.readBatch(ms)
+		} else {
+			err = l.readPacket()
+		}
+
 		if err != nil {
 			return err
 		}
@@ -155,22 +438,29 @@ func (l *Listener) run() (err error) {
 }
 
 func (l *Listener) readPacket() (err error) {
-	buf := make(wire.Packet, 2000)
+	buf := l.pool.get(l.MaxTransmissonUnit)
 
 	n, addr, err := l.p.ReadFrom(buf)
 	if err != nil {
+		l.pool.put(buf)
+
 		return errors.Wrap(err, "read packet")
 	}
 
-	buf = buf[:n]
+	return l.handlePacket(buf[:n], addr, low.Monotonic())
+}
 
-	ts := low.Monotonic()
+// handlePacket dispatches the packet. It takes ownership of the buffer.
+func (l *Listener) handlePacket(buf wire.Packet, addr net.Addr, ts int64) (err error) {
+	n := len(buf)
 
 	if tlog.If("raw") {
 		tlog.Printf("packet from %v\n%s", addr, hex.Dump(buf))
 	}
 
 	if n < buf.MinSize() {
+		l.pool.put(buf)
+
 		return errors.New("short packet")
 	}
 
@@ -182,13 +472,16 @@ func (l *Listener) readPacket() (err error) {
 		return errors.Wrap(err, "handshake")
 	}
 
-	c := l.socks[key(addr, sid)]
+	c := l.conn(addr, sid)
 
 	if c == nil {
+		l.pool.put(buf)
+
 		return errors.New("no socket")
 	}
 
-	err = c.recv(buf[:n], addr, ts)
+	// c.recv takes buffer ownership
+	err = c.recv(buf, addr, ts)
 	if err != nil {
 		return errors.Wrap(err, "recv: sid %x", sid)
 	}
@@ -199,24 +492,66 @@ func (l *Listener) readPacket() (err error) {
 func (l *Listener) handleHandshake(p wire.Handshake, addr net.Addr, ts int64) (err error) {
 	dstid := wire.Packet(p).SocketID()
 
+	if tp := p.Type(); len(p) >= p.MinSize() && tp >= wire.RejectionBase && tp < wire.Done {
+		return l.rejected(p, addr)
+	}
+
+	if c := l.conn(addr, dstid); c != nil && dstid != 0 {
+		return l.repeatHandshake(c, p, addr)
+	}
+
+	// caller resends conclusion to zero socket id until it gets our response
+	if dstid == 0 && len(p) >= p.MinSize() && p.Type() == wire.Conclusion {
+		if c := l.peer(addr, p.SocketID()); c != nil {
+			return l.repeatHandshake(c, p, addr)
+		}
+	}
+
+	if req := l.rendezvous(addr); req != nil {
+		return l.handleRendezvous(req, p, addr, ts)
+	}
+
+	var hdr wire.Handshake
+	if len(p) >= p.MinSize() && p.Type() == wire.Conclusion {
+		hdr = append(hdr, p[:p.MinSize()]...)
+	}
+
 	var d conndata
 	p, d, err = l.parseHandshake(p, addr, ts)
 
-	req, reqok := l.conng[d.lid]
+	req := l.request(dstid)
+	reqok := req != nil
+
+	if reqok && req.c != nil {
+		return nil // already connected
+	}
 	if reqok {
 		defer func() {
 			if err != nil {
-				req.errc <- err
+				req.done(err)
 			}
 		}()
 	}
 
+	if err != nil && hdr != nil && !errors.Is(err, errBadCookie) {
+		l.reject(hdr, addr, err)
+	}
+
 	if err != nil {
 		return errors.Wrap(err, "parse")
 	}
 
 	tlog.Printw("handshake", "tp_conclusion", d.tp == wire.Conclusion, "local_sid", tlog.Hex(dstid))
 
+	if d.tp == wire.Conclusion && !reqok {
+		err = l.admit(addr, &d)
+		if err != nil {
+			l.reject(hdr, addr, err)
+
+			return errors.Wrap(err, "rejected")
+		}
+	}
+
 	if d.tp != wire.Conclusion || dstid == 0 {
 		_, err = l.WriteTo(p, addr)
 		if err != nil {
@@ -228,7 +563,34 @@ func (l *Listener) handleHandshake(p wire.Handshake, addr net.Addr, ts int64) (e
 		return nil
 	}
 
-	c := &Conn{
+	c := l.newConn(addr, &d, ts)
+
+	if dstid == 0 {
+		c.hsrsp = append(wire.Handshake{}, p...)
+	}
+
+	if reqok {
+		l.register(c)
+
+		go c.loop()
+
+		req.c = c
+		req.done(nil)
+
+		return nil
+	}
+
+	err = l.accepted(c, addr)
+	if err != nil {
+		return errors.Wrap(err, "accept")
+	}
+
+	return nil
+}
+
+func (l *Listener) newConn(addr net.Addr, d *conndata, ts int64) (c *Conn) {
+	c = &Conn{
+		l:        l,
 		p:        sender{PacketConn: l.p},
 		addr:     addr,
 		localid:  d.lid,
@@ -236,36 +598,277 @@ func (l *Listener) handleHandshake(p wire.Handshake, addr net.Addr, ts int64) (e
 
 		epoch: ts,
 
-		readnotify: make(chan struct{}, 1),
+		lastRecv: ts,
+		lastSent: ts,
+		idle:     int64(l.PeerIdleTimeout),
+		linger:   l.Linger,
+
+		mtu:     d.mtu,
+		window:  d.window,
+		bufsize: l.MaxFlowWindow,
+
+		rtt:    int64(defaultRTT),
+		rttVar: int64(defaultRTT / 2),
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+
+		stopc: make(chan struct{}),
 	}
 
-	c.s.seq = d.lseq
+	c.s.seq = seqno.Dec(d.lseq)
 	c.r.seq = d.rseq
+	c.r.window = l.MaxFlowWindow
+	c.r.pool = &l.pool
+	c.pool = &l.pool
 
-	if reqok {
-		req.c = c
-		req.errc <- nil
+	if n := l.batchPackets(); n > 1 {
+		c.p = sender{PacketConn: l.p, b: l.batch}
+		c.batch = n
+	}
+
+	c.last = d.rseq
+
+	c.s.base = ts
+	c.crypto = d.crypto
+
+	if d.crypto != nil {
+		c.rcrypto = d.crypto.clone()
+	}
+	c.streamid = d.streamid
+	c.pass = l.Passphrase
+	c.kmRefresh = l.KeyRefreshRate
+	c.kmPre = l.KeyPreannounce
+	c.hsv4 = d.ver == 4
+
+	l.setupConn(c, d)
+
+	return c
+}
+
+// setupConn applies negotiated SRT options.
+func (l *Listener) setupConn(c *Conn, d *conndata) {
+	c.slatency = d.slatency
 
+	if d.pflags&wire.FlagTSBPDSend != 0 {
+		c.r.latency = d.rlatency
+	}
+
+	if l.TooLatePacketDrop && d.pflags&wire.FlagTLPktDrop != 0 {
+		c.r.drop = c.r.latency != 0
+		c.sdrop = c.slatency != 0
+	}
+
+	if l.congestion() == "live" {
+		c.cc.live = true
+		c.cc.maxbw = l.MaxBW
+		c.cc.inputbw = l.InputBW
+		c.cc.overhead = l.OverheadBW
+	}
+}
+
+// negotiateMTU returns the smaller of ours and the peer MTU.
+// Too small MTU leaves no room for payload so the peer is rejected.
+func (l *Listener) negotiateMTU(peer int) (mtu int, err error) {
+	mtu = l.MaxTransmissonUnit
+	if peer < mtu {
+		mtu = peer
+	}
+
+	if mtu < minMTU {
+		return 0, rejectf(wire.RejRogue, "mtu is too small: %d", mtu)
+	}
+
+	return mtu, nil
+}
+
+func (l *Listener) congestion() string {
+	if l.Congestion == "" {
+		return "live"
+	}
+
+	return l.Congestion
+}
+
+// repeatHandshake answers handshake for established connection
+// in case the peer has lost our response.
+func (l *Listener) repeatHandshake(c *Conn, p wire.Handshake, addr net.Addr) (err error) {
+	if len(p) < p.MinSize() || p.Type() != wire.Conclusion || c.hsrsp == nil {
 		return nil
 	}
 
-	err = l.accepted(c, addr)
+	_, err = l.WriteTo(c.hsrsp, addr)
 	if err != nil {
-		return errors.Wrap(err, "accept")
+		return errors.Wrap(err, "send resp")
 	}
 
 	return nil
 }
 
 func (l *Listener) accepted(c *Conn, addr net.Addr) (err error) {
+	l.register(c)
+
 	select {
 	case l.acceptc <- c:
 	default:
-		panic("stop")
+		l.forget(c)
+
 		return errors.New("full buffer")
 	}
 
-	l.socks[key(addr, c.localid)] = c
+	go c.loop()
+
+	return nil
+}
+
+// done reports the result to the waiting Connect or Rendezvous call.
+// Only the first result is taken.
+func (req *connreq) done(err error) {
+	select {
+	case req.errc <- err:
+	default:
+	}
+}
+
+func (l *Listener) request(id uint32) *connreq {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.conng[id]
+}
+
+func (l *Listener) rendezvous(addr net.Addr) *connreq {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rdv[key(addr, 0)]
+}
+
+func (l *Listener) random() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return uint32(l.rand.Int31())
+}
+
+func (l *Listener) conn(addr net.Addr, sid uint32) *Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.socks[key(addr, sid)]
+}
+
+func (l *Listener) peer(addr net.Addr, sid uint32) *Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.peers[key(addr, sid)]
+}
+
+func (l *Listener) register(c *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.socks[key(c.addr, c.localid)] = c
+	l.peers[key(c.addr, c.remoteid)] = c
+}
+
+// forget removes the connection from the listener.
+func (l *Listener) forget(c *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := key(c.addr, c.localid)
+
+	if l.socks[k] == c {
+		delete(l.socks, k)
+	}
+
+	k = key(c.addr, c.remoteid)
+
+	if l.peers[k] == c {
+		delete(l.peers, k)
+	}
+}
+
+// admit decides if the caller is to be accepted.
+func (l *Listener) admit(addr net.Addr, d *conndata) (err error) {
+	if len(l.acceptc) == cap(l.acceptc) {
+		return &RejectError{Reason: wire.RejBacklog}
+	}
+
+	if l.AcceptFilter == nil {
+		return nil
+	}
+
+	req := &ConnRequest{
+		Addr:     addr,
+		StreamID: d.streamid,
+
+		Version:    int(d.ver),
+		SRTVersion: d.srtver,
+
+		Latency: time.Duration(d.rlatency),
+
+		MaxTransmissonUnit: d.mtu,
+		MaxFlowWindow:      d.window,
+	}
+
+	if d.crypto != nil {
+		req.Encryption = int(wire.EncryptionByKeyLen(d.crypto.klen))
+		req.CryptoMode = d.crypto.cipher
+	}
+
+	return l.AcceptFilter(req)
+}
+
+// reject sends rejection in response to the peer conclusion handshake header.
+func (l *Listener) reject(p wire.Handshake, addr net.Addr, err error) {
+	reason := wire.RejPeer
+
+	var rej *RejectError
+	if errors.As(err, &rej) {
+		reason = rej.Reason
+	}
+
+	wire.Packet(p).SetSocketID(p.SocketID())
+
+	p.SetVersion(5)
+	p.SetExtensions(0)
+	p.SetType(uint32(wire.RejectionBase + reason))
+
+	_, err = l.WriteTo(p, addr)
+	if err != nil {
+		tlog.Printw("send rejection", "reason", reason, "err", err)
+	}
+}
+
+// rejected handles rejection from the peer.
+func (l *Listener) rejected(p wire.Handshake, addr net.Addr) (err error) {
+	dstid := wire.Packet(p).SocketID()
+
+	err = &RejectError{Reason: int(p.Type() - wire.RejectionBase)}
+
+	tlog.Printw("handshake rejected", "local_sid", tlog.Hex(dstid), "err", err)
+
+	if req := l.request(dstid); req != nil {
+		req.done(err)
+
+		return nil
+	}
+
+	if req := l.rendezvous(addr); req != nil {
+		l.rendezvousDone(req, addr, nil, err)
+
+		return nil
+	}
+
+	c := l.conn(addr, dstid)
+	if c == nil {
+		return errors.Wrap(err, "no socket")
+	}
+
+	c.shutdown()
 
 	return nil
 }
@@ -306,16 +909,27 @@ func (l *Listener) parseHandshake(p wire.Handshake, addr net.Addr, ts int64) (_
 		}
 	}()
 
+	if ver != 4 && ver != 5 {
+		return nil, d, rejectf(wire.RejVersion, "unsupported version")
+	}
+
 	dst := wire.Packet(p).SocketID()
 
 	d.tp = p.Type()
+	d.ver = ver
 	cookie := p.Cookie()
 
 	wire.Packet(p).SetSocketID(p.SocketID())
 
 	p, err = l.procExts(p, &d)
 	if err != nil {
-		return nil, d, errors.Wrap(err, "extensions")
+		return nil, d, rejectf(wire.RejRogue, "extensions: %v", err)
+	}
+
+	switch d.congestion {
+	case "", "live", "file":
+	default:
+		return nil, d, rejectf(wire.RejCongestion, "unsupported congestion control: %q", d.congestion)
 	}
 
 	switch {
@@ -330,7 +944,7 @@ func (l *Listener) parseHandshake(p wire.Handshake, addr net.Addr, ts int64) (_
 			return nil, d, errors.New("bad cookie")
 		}
 
-		cookie = calcCookie(addr, ts)
+		cookie = l.cookie(addr, ts)
 		p.SetCookie(cookie)
 		p.SetSocketID(0)
 	case ver == 5 && d.tp == wire.Induction: // second req
@@ -338,25 +952,74 @@ func (l *Listener) parseHandshake(p wire.Handshake, addr net.Addr, ts int64) (_
 
 		p.SetSocketID(dst)
 
-		ext := make(wire.Ext, wire.HandshakeExt{}.Size())
+		p, err = l.appendReqExts(p, l.request(dst))
+		if err != nil {
+			return nil, d, err
+		}
+	case ver == 4 && d.tp == wire.Conclusion: // legacy caller, SRT options follow in control messages
+		if !l.checkCookie(addr, ts, cookie) {
+			return nil, d, errBadCookie
+		}
 
-		ext.SetHeader(1, wire.HandshakeExt{}.Size())
-		wire.HandshakeExt(ext).SetVersion(1, 4, 0)
-		wire.HandshakeExt(ext).SetFlags(0)
+		if l.request(dst) != nil {
+			return nil, d, rejectf(wire.RejVersion, "legacy handshake response")
+		}
 
-		p = append(p, ext...)
+		d.rid = p.SocketID()
+		d.rseq = seqno.Dec(p.Seq())
 
-		p = append(p, []byte{0x00, 0x06, 0x00, 0x01, 'e', 'l', 'i', 'f'}...)
+		d.mtu, err = l.negotiateMTU(p.MaxTransmissonUnit())
+		if err != nil {
+			return nil, d, err
+		}
+
+		d.window = p.MaxFlowWindow()
+
+		d.lid = l.random()
+		d.lseq = l.random()
+
+		p.SetSeq(d.lseq)
+		p.SetSocketID(d.lid)
 	case ver == 5 && d.tp == wire.Conclusion: // second resp
 		if cookie == 0 {
 			return nil, d, errors.New("bad cookie")
 		}
 
-		d.lid = uint32(l.rand.Int31())
 		d.rid = p.SocketID()
+		d.rseq = seqno.Dec(p.Seq())
+
+		d.mtu, err = l.negotiateMTU(p.MaxTransmissonUnit())
+		if err != nil {
+			return nil, d, err
+		}
+
+		d.window = p.MaxFlowWindow()
 
-		d.lseq = uint32(l.rand.Int31())
-		d.rseq = p.Seq() - 1
+		if req := l.request(dst); req != nil { // caller side
+			d.lid = req.id
+			d.lseq = req.seq
+
+			if req.crypto != nil && d.kmrsp == nil {
+				return nil, d, rejectf(wire.RejUnsecure, "encryption is not supported by peer")
+			}
+
+			d.crypto = req.crypto
+			d.streamid = req.streamid
+
+			break
+		}
+
+		if !l.checkCookie(addr, ts, cookie) {
+			return nil, d, errBadCookie
+		}
+
+		err = l.acceptCrypto(&d)
+		if err != nil {
+			return nil, d, err
+		}
+
+		d.lid = l.random()
+		d.lseq = l.random()
 
 		p.SetSeq(d.lseq)
 		p.SetSocketID(d.lid)
@@ -364,8 +1027,10 @@ func (l *Listener) parseHandshake(p wire.Handshake, addr net.Addr, ts int64) (_
 		return nil, d, errors.New("bad handshake")
 	}
 
-	p.SetVersion(5)
-	p.SetEncryption(uint16(l.Encryption))
+	if ver == 5 || d.tp == wire.Induction {
+		p.SetVersion(5)
+		p.SetEncryption(uint16(l.Encryption))
+	}
 
 	p.SetMaxTransmissionUnit(uint32(l.MaxTransmissonUnit))
 	p.SetMaxFlowWindow(uint32(l.MaxFlowWindow))
@@ -373,47 +1038,175 @@ func (l *Listener) parseHandshake(p wire.Handshake, addr net.Addr, ts int64) (_
 	return p, d, nil
 }
 
-func (l *Listener) procExts(p wire.Handshake, d *conndata) (_ wire.Handshake, err error) {
-	for st := p.ExtStart(); st < len(p); {
-		tp, _, next := p.Ext(st)
+// appendReqExts adds caller extensions to the conclusion request.
+func (l *Listener) appendReqExts(p wire.Handshake, req *connreq) (_ wire.Handshake, err error) {
+	ext := make(wire.Ext, wire.HandshakeExt{}.Size())
 
-		switch tp {
-		case 1: // handshake request
-			p[st+1] = 2 // resp
-		case 6: // congestion
+	ext.SetHeader(wire.HSReqExt, wire.HandshakeExt{}.Size())
+	wire.HandshakeExt(ext).SetVersion(1, 4, 0)
+	wire.HandshakeExt(ext).SetFlags(l.hsFlags())
+	wire.HandshakeExt(ext).SetTSBPDDelays(int64(l.Latency), int64(l.Latency))
+
+	p = append(p, ext...)
+
+	if req != nil && req.crypto != nil {
+		km, err := req.crypto.keyMaterial(l.Passphrase, wire.KeyEven)
+		if err != nil {
+			return nil, errors.Wrap(err, "key material")
 		}
 
+		p = append(p, wire.MakeExt(wire.KMReqExt, km)...)
+	}
+
+	if req != nil && req.streamid != "" {
+		p = append(p, wire.MakeStringExt(wire.StreamIDExt, req.streamid)...)
+	}
+
+	if cc := l.congestion(); cc != "live" {
+		p = append(p, wire.MakeStringExt(wire.CongestionExt, cc)...)
+	}
+
+	return p, nil
+}
+
+// acceptCrypto checks the peer encryption request on the responding side.
+func (l *Listener) acceptCrypto(d *conndata) (err error) {
+	switch {
+	case d.kmreq != nil && l.Passphrase != "":
+		if l.CryptoMode != 0 && d.kmreq.Valid() && d.kmreq.Cipher() != l.CryptoMode {
+			return rejectf(wire.RejCrypto, "crypto mode mismatch: %d", d.kmreq.Cipher())
+		}
+
+		d.crypto, err = parseKeyMaterial(d.kmreq, l.Passphrase)
+		if errors.Is(err, ErrBadSecret) {
+			return rejectf(wire.RejBadSecret, "key material")
+		}
+		if err != nil {
+			return rejectf(wire.RejCrypto, "key material: %v", err)
+		}
+	case d.kmreq != nil:
+		return rejectf(wire.RejUnsecure, "encryption is not configured")
+	case l.Passphrase != "":
+		return rejectf(wire.RejUnsecure, "peer is not encrypted")
+	}
+
+	return nil
+}
+
+func (l *Listener) procExts(p wire.Handshake, d *conndata) (_ wire.Handshake, err error) {
+	for st := p.ExtStart(); st < len(p); {
+		tp, data, next := p.Ext(st)
+
 		if next == -1 {
 			return nil, errors.New("bad extension: %x at %x", tp, st)
 		}
 
+		switch tp {
+		case wire.HSReqExt, wire.HSRspExt:
+			if len(data) < (wire.HandshakeExt{}).Size() {
+				return nil, errors.New("bad handshake extension size: %d", len(data))
+			}
+
+			l.negotiate(wire.HandshakeExt(data), d, tp == wire.HSRspExt)
+
+			if tp == wire.HSReqExt {
+				p[st+1] = wire.HSRspExt
+			}
+		case wire.KMReqExt:
+			d.kmreq = wire.KeyMaterial(data[4:])
+
+			p[st+1] = wire.KMRspExt
+		case wire.KMRspExt:
+			d.kmrsp = wire.KeyMaterial(data[4:])
+		case wire.StreamIDExt:
+			d.streamid = wire.ExtString(data[4:])
+		case wire.CongestionExt:
+			d.congestion = wire.ExtString(data[4:])
+		}
+
 		st = next
 	}
 
 	return p, nil
 }
 
+func (l *Listener) negotiate(e wire.HandshakeExt, d *conndata, rsp bool) {
+	d.pflags = e.Flags()
+
+	major, minor, patch := e.Version()
+	d.srtver = uint32(major<<16 | minor<<8 | patch)
+
+	precv, psend := e.TSBPDDelays()
+
+	if rsp { // peer have already negotiated
+		d.rlatency = psend
+		d.slatency = precv
+
+		return
+	}
+
+	d.rlatency = psend
+	if lat := int64(l.Latency); lat > d.rlatency {
+		d.rlatency = lat
+	}
+
+	d.slatency = precv
+	if lat := int64(l.Latency); lat > d.slatency {
+		d.slatency = lat
+	}
+
+	flags := l.hsFlags()
+	if d.rlatency != 0 || d.slatency != 0 {
+		flags |= wire.FlagTSBPDSend | wire.FlagTSBPDRecv
+	}
+
+	e.SetVersion(1, 4, 0)
+	e.SetFlags(flags)
+	e.SetTSBPDDelays(d.rlatency, d.slatency)
+}
+
+func (l *Listener) hsFlags() (f uint32) {
+	if l.Latency != 0 {
+		f |= wire.FlagTSBPDSend | wire.FlagTSBPDRecv
+	}
+
+	if l.TooLatePacketDrop {
+		f |= wire.FlagTLPktDrop
+	}
+
+	if l.Passphrase != "" {
+		f |= wire.FlagCrypt
+	}
+
+	return f
+}
+
 func (l *Listener) checkHandshake(p wire.Handshake, addr net.Addr, ts int64) (err error) {
 	if len(p) < p.MinSize() {
 		return errors.New("too short")
 	}
 
 	enc := p.Encryption()
-	if enc != wire.NoEncryption {
-		return errors.New("bad encryption")
+	if enc != wire.NoEncryption && wire.KeyLen(enc) == 0 {
+		return errors.New("bad encryption: %x", enc)
 	}
 
 	return nil
 }
 
 func (l *Listener) Accept() (c net.Conn, err error) {
-	select {
-	case c = <-l.acceptc:
-	case <-l.stopc:
-		return nil, errors.New("stopped")
-	}
+	for {
+		select {
+		case x := <-l.acceptc:
+			if l.conn(x.addr, x.localid) != x { // closed before accepted
+				continue
+			}
 
-	return
+			return x, nil
+		case <-l.stopc:
+			return nil, net.ErrClosed
+		}
+	}
 }
 
 func (l *Listener) WriteTo(p []byte, addr net.Addr) (n int, err error) {
@@ -426,15 +1219,45 @@ func (l *Listener) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return
 }
 
-func calcCookie(a net.Addr, ts int64) (c uint32) {
-	ts /= int64(time.Minute)
+func (l *Listener) cryptoMode() int {
+	if l.CryptoMode != 0 {
+		return l.CryptoMode
+	}
+
+	return wire.CipherCTR
+}
+
+func (l *Listener) keyLen() int {
+	if n := wire.KeyLen(uint16(l.Encryption)); n != 0 {
+		return n
+	}
+
+	return wire.KeyLen(wire.AES128)
+}
+
+// cookie is a keyed hash of the peer address and the current minute.
+func (l *Listener) cookie(a net.Addr, ts int64) uint32 {
+	return l.cookieAt(a, ts/int64(time.Minute))
+}
+
+// checkCookie accepts cookies of the current and the previous minutes.
+func (l *Listener) checkCookie(a net.Addr, ts int64, c uint32) bool {
+	m := ts / int64(time.Minute)
+
+	return c == l.cookieAt(a, m) || c == l.cookieAt(a, m-1)
+}
+
+func (l *Listener) cookieAt(a net.Addr, m int64) uint32 {
+	var buf [sha256.Size]byte
+
+	binary.BigEndian.PutUint64(buf[:], uint64(m))
 
-	var h uintptr
+	h := hmac.New(sha256.New, l.secret[:])
 
-	h = low.StrHash(a.String(), h)
-	h = low.MemHash64(unsafe.Pointer(&ts), h)
+	_, _ = h.Write(buf[:8])
+	_, _ = h.Write([]byte(a.String()))
 
-	return uint32(h)
+	return binary.BigEndian.Uint32(h.Sum(buf[:0]))
 }
 
 func key(addr net.Addr, sid uint32) (k sockkey) {
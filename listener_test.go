@@ -1,13 +1,18 @@
 package srt
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/nikandfor/errors"
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/low"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/nikandfor/srt/wire"
 )
@@ -30,6 +35,17 @@ type (
 		p    wire.Packet
 		addr net.Addr
 	}
+
+	// benchPacketConn endlessly reads data packets for one connection
+	// and discards written ones.
+	benchPacketConn struct {
+		net.PacketConn
+
+		addr *net.UDPAddr
+		sid  uint32
+		seq  uint32
+		size int
+	}
 )
 
 func TestListenerAccept(t *testing.T) {
@@ -38,6 +54,7 @@ func TestListenerAccept(t *testing.T) {
 	var pc testPacketConn
 
 	l := newListener(&pc)
+	defer l.Close()
 
 	l.Encryption = wire.NoEncryption
 
@@ -58,6 +75,8 @@ func TestListenerAccept(t *testing.T) {
 		}, addr: testAddr("a")},
 	}
 
+	wire.Handshake(pc.r[1].p).SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+
 	phase := 1
 
 	pc.exp = map[string]testChecker{
@@ -84,7 +103,7 @@ func TestListenerAccept(t *testing.T) {
 				assert.EqualValues(t, 5, h.Extensions())
 			}
 
-			assert.EqualValues(t, calcCookie(testAddr("a"), low.Monotonic()), h.Cookie())
+			assert.EqualValues(t, l.cookie(testAddr("a"), low.Monotonic()), h.Cookie())
 
 			return true, len(tp.p), nil
 		},
@@ -97,6 +116,284 @@ func TestListenerAccept(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestListenerRepeatedConclusion(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	l.Encryption = wire.NoEncryption
+
+	filtered := 0
+
+	l.AcceptFilter = func(r *ConnRequest) error {
+		filtered++
+
+		return nil
+	}
+
+	conclusion := wire.Packet{
+		0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x05, 0x26, 0x88, 0x47, 0x89, 0x00, 0x00, 0x05, 0xdc,
+		0x00, 0x00, 0x20, 0x00, 0xff, 0xff, 0xff, 0xff, 0x20, 0x9e, 0x7d, 0x6d, 0x9d, 0x89, 0x51, 0x86,
+		0x01, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x01, 0x00, 0x03, 0x00, 0x01, 0x04, 0x03, 0x00, 0x00, 0x00, 0xe4, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x06, 0x00, 0x01, 0x65, 0x6c, 0x69, 0x66,
+	}
+
+	wire.Handshake(conclusion).SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+
+	pc.r = []testPacket{
+		{p: conclusion, addr: testAddr("a")},
+		{p: conclusion, addr: testAddr("a")},
+	}
+
+	for i := range pc.r {
+		err := l.readPacket()
+		require.NoError(t, err, "packet %d", i)
+	}
+
+	assert.Equal(t, 1, filtered)
+	assert.Len(t, l.acceptc, 1)
+	assert.Len(t, l.socks, 1)
+
+	if assert.Len(t, pc.w, 2) {
+		assert.Equal(t, pc.w[0].p, pc.w[1].p, "repeated response")
+	}
+}
+
+func TestListenerAcceptFilter(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "raw", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	l.Encryption = wire.NoEncryption
+
+	var req *ConnRequest
+
+	l.AcceptFilter = func(r *ConnRequest) error {
+		req = r
+
+		return &RejectError{Reason: wire.RejResource}
+	}
+
+	pc.r = []testPacket{
+		{p: []byte{
+			0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x63, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x02, 0x26, 0x88, 0x47, 0x89, 0x00, 0x00, 0x05, 0xdc,
+			0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x01, 0x20, 0x9e, 0x7d, 0x6d, 0x00, 0x00, 0x00, 0x00,
+			0x01, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}, addr: testAddr("a")},
+		{p: []byte{
+			0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x05, 0x26, 0x88, 0x47, 0x89, 0x00, 0x00, 0x05, 0xdc,
+			0x00, 0x00, 0x20, 0x00, 0xff, 0xff, 0xff, 0xff, 0x20, 0x9e, 0x7d, 0x6d, 0x9d, 0x89, 0x51, 0x86,
+			0x01, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x01, 0x00, 0x03, 0x00, 0x01, 0x04, 0x03, 0x00, 0x00, 0x00, 0xe4, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x06, 0x00, 0x01, 0x65, 0x6c, 0x69, 0x66,
+		}, addr: testAddr("a")},
+	}
+
+	wire.Handshake(pc.r[1].p).SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+
+	err := l.readPacket()
+	assert.NoError(t, err)
+
+	err = l.readPacket()
+	assert.Error(t, err)
+
+	if assert.NotNil(t, req) {
+		assert.Equal(t, 5, req.Version)
+		assert.EqualValues(t, 0x010403, req.SRTVersion)
+		assert.Equal(t, 1500, req.MaxTransmissonUnit)
+	}
+
+	if assert.Len(t, pc.w, 2) {
+		h := wire.Handshake(pc.w[1].p)
+		assert.EqualValues(t, wire.RejectionBase+wire.RejResource, h.Type())
+	}
+
+	assert.Len(t, l.acceptc, 0)
+	assert.Len(t, l.socks, 0)
+}
+
+func TestListenerHSv4(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "raw", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+	l.Latency = 120 * time.Millisecond
+
+	p := l.newHandshake(wire.Conclusion, 0x1234)
+	p.SetVersion(4)
+	p.SetExtensions(2)
+	p.SetSeq(0x100)
+	p.SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+
+	r, d, err := l.parseHandshake(p, testAddr("a"), low.Monotonic())
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 4, r.Version())
+	assert.EqualValues(t, 2, r.Extensions())
+	assert.EqualValues(t, wire.Conclusion, r.Type())
+	assert.EqualValues(t, 0x1234, wire.Packet(r).SocketID())
+	assert.EqualValues(t, 0x1234, d.rid)
+	assert.EqualValues(t, 0xff, d.rseq)
+
+	c := l.newConn(testAddr("a"), &d, low.Monotonic())
+	assert.True(t, c.hsv4)
+	assert.Zero(t, c.r.latency)
+
+	e := make(wire.Ext, wire.HandshakeExt{}.Size())
+	wire.HandshakeExt(e).SetVersion(1, 2, 0)
+	wire.HandshakeExt(e).SetFlags(wire.FlagTSBPDSend)
+	wire.HandshakeExt(e).SetTSBPDDelays(0, int64(80*time.Millisecond))
+
+	q := make(wire.Packet, wire.Packet{}.MinSize()+len(e)-4)
+	q.SetControlType(wire.UserDefinedType, wire.HSReqExt)
+	copy(q[q.MinSize():], e[4:])
+
+	err = c.recv(q, testAddr("a"), low.Monotonic())
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 120*time.Millisecond, c.r.latency)
+
+	if assert.Len(t, pc.w, 1) {
+		tp, sub := pc.w[0].p.ControlType()
+		assert.EqualValues(t, wire.UserDefinedType, tp)
+		assert.EqualValues(t, wire.HSRspExt, sub)
+	}
+}
+
+func TestListenerHSv4Encrypted(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	l.Passphrase = "secret"
+
+	p := l.newHandshake(wire.Conclusion, 0x1234)
+	p.SetVersion(4)
+	p.SetExtensions(2)
+	p.SetSeq(0x100)
+	p.SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+
+	_, d, err := l.parseHandshake(p, testAddr("a"), low.Monotonic())
+	require.NoError(t, err)
+
+	c := l.newConn(testAddr("a"), &d, low.Monotonic())
+
+	err = c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte("data"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "err: %v", err)
+	assert.Len(t, pc.w, 0, "no plaintext sent")
+
+	cr, err := newCrypter(wire.CipherCTR, 16)
+	require.NoError(t, err)
+
+	km, err := cr.keyMaterial("secret", wire.KeyEven)
+	require.NoError(t, err)
+
+	q := make(wire.Packet, wire.Packet{}.MinSize()+len(km))
+	q.SetControlType(wire.UserDefinedType, wire.KMReqExt)
+	copy(q[q.MinSize():], km)
+
+	err = c.recv(q, testAddr("a"), low.Monotonic())
+	require.NoError(t, err)
+
+	err = c.SetWriteDeadline(time.Time{})
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte("data"))
+	require.NoError(t, err)
+
+	if assert.Len(t, pc.w, 2) {
+		assert.True(t, wire.DataPacket(pc.w[1].p).Encrypted())
+	}
+
+	c = l.newConn(testAddr("b"), &d, low.Monotonic())
+
+	err = c.timers(c.epoch + int64(keyMaterialTimeout) + 1)
+	assert.NoError(t, err)
+
+	var rej *RejectError
+	if assert.True(t, errors.As(c.err, &rej), "err: %v", c.err) {
+		assert.Equal(t, wire.RejUnsecure, rej.Reason)
+	}
+}
+
+func TestListenerSmallMTU(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	p := l.newHandshake(wire.Conclusion, 0x1234)
+	p.SetVersion(4)
+	p.SetExtensions(2)
+	p.SetCookie(l.cookie(testAddr("a"), low.Monotonic()))
+	p.SetMaxTransmissionUnit(20)
+
+	_, _, err := l.parseHandshake(p, testAddr("a"), low.Monotonic())
+
+	var rej *RejectError
+	if assert.True(t, errors.As(err, &rej), "err: %v", err) {
+		assert.Equal(t, wire.RejRogue, rej.Reason)
+	}
+}
+
+func TestListenerCookie(t *testing.T) {
+	l := newListener(nil)
+
+	a := testAddr("a")
+	ts := 10 * int64(time.Minute)
+
+	c := l.cookie(a, ts)
+
+	assert.True(t, l.checkCookie(a, ts, c))
+	assert.True(t, l.checkCookie(a, ts+int64(time.Minute), c))
+	assert.False(t, l.checkCookie(a, ts+2*int64(time.Minute), c))
+	assert.False(t, l.checkCookie(a, ts-int64(time.Minute), c))
+	assert.False(t, l.checkCookie(testAddr("b"), ts, c))
+
+	assert.NotEqual(t, c, newListener(nil).cookie(a, ts), "per listener secret")
+}
+
+func TestListenerStreamIDExt(t *testing.T) {
+	assert.Equal(t, []byte{0x00, 0x06, 0x00, 0x01, 'e', 'l', 'i', 'f'}, []byte(wire.MakeStringExt(wire.CongestionExt, "file")))
+
+	sid := "#!::r=live/feed1,m=publish"
+
+	e := wire.MakeStringExt(wire.StreamIDExt, sid)
+	assert.Len(t, e, 4+28)
+	assert.Equal(t, "::!#", string(e[4:8]))
+
+	p := make(wire.Handshake, wire.Handshake{}.MinSize())
+	p = append(p, e...)
+
+	var d conndata
+
+	l := newListener(nil)
+
+	_, err := l.procExts(p, &d)
+	assert.NoError(t, err)
+	assert.Equal(t, sid, d.streamid)
+}
+
 func (c *testPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if c.ri == len(c.r) {
 		return 0, nil, errors.New("no more packets")
@@ -111,9 +408,13 @@ func (c *testPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	return
 }
 
+func (c *testPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
 func (c *testPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	c.w = append(c.w, testPacket{
-		p:    p,
+		p:    append(wire.Packet{}, p...),
 		addr: addr,
 	})
 
@@ -135,3 +436,317 @@ func (c *testPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 
 	return n, err
 }
+
+func TestListenerRejected(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "raw", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+
+	req := &connreq{
+		id:   0x1234,
+		errc: make(chan error, 1),
+	}
+
+	l.conng[req.id] = req
+
+	p := l.newHandshake(wire.Conclusion, 0x5678)
+	p.SetType(wire.RejectionBase + wire.RejBadSecret)
+	wire.Packet(p).SetSocketID(req.id)
+
+	pc.r = []testPacket{{p: wire.Packet(p), addr: testAddr("a")}}
+
+	err := l.readPacket()
+	assert.NoError(t, err)
+
+	var rej *RejectError
+	if assert.True(t, errors.As(<-req.errc, &rej)) {
+		assert.Equal(t, wire.RejBadSecret, rej.Reason)
+		assert.Equal(t, "rejected: bad secret", rej.Error())
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	l, err := Listen("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	assert.True(t, l.OwnsPacketConn())
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, err := l.Accept()
+		errc <- err
+	}()
+
+	c := l.newConn(testAddr("a"), &conndata{lid: 0x1234}, low.Monotonic())
+	c.p = &testPacketConn{}
+
+	l.register(c)
+
+	err = l.Close()
+	assert.NoError(t, err)
+
+	<-l.donec
+
+	assert.True(t, errors.Is(<-errc, net.ErrClosed))
+	assert.Len(t, l.socks, 0)
+
+	_, err = c.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, net.ErrClosed), "conn read: %v", err)
+
+	_, err = l.Connect(context.Background(), testAddr("b"))
+	assert.True(t, errors.Is(err, net.ErrClosed), "connect: %v", err)
+
+	err = l.Close()
+	assert.True(t, errors.Is(err, net.ErrClosed), "second close: %v", err)
+
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer p.Close()
+
+	l = New(p)
+	assert.False(t, l.OwnsPacketConn())
+
+	err = l.Close()
+	assert.NoError(t, err)
+
+	<-l.donec
+
+	_, err = p.WriteTo([]byte("still open"), p.LocalAddr())
+	assert.NoError(t, err)
+}
+
+func TestListenerStress(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	const conns, msgs = 8, 50
+
+	srv, err := Listen("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer srv.Close()
+
+	cl, err := Listen("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer cl.Close()
+
+	go func() {
+		for {
+			c, err := srv.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				buf := make([]byte, 1000)
+
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+
+					_, err = c.Write(buf[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	errc := make(chan error, conns)
+
+	for i := 0; i < conns; i++ {
+		go func(i int) {
+			errc <- stressConn(cl, srv.Addr(), i, msgs)
+		}(i)
+	}
+
+	for i := 0; i < conns; i++ {
+		assert.NoError(t, <-errc)
+	}
+}
+
+func stressConn(l *Listener, addr net.Addr, i, msgs int) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var c *Conn
+
+	for {
+		c, err = l.Connect(ctx, addr)
+
+		var rej *RejectError
+		if errors.As(err, &rej) && rej.Reason == wire.RejBacklog {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "connect")
+		}
+
+		break
+	}
+
+	defer c.Close()
+
+	err = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1000)
+
+	for j := 0; j < msgs; j++ {
+		msg := fmt.Sprintf("conn %d message %d", i, j)
+
+		_, err = c.Write([]byte(msg))
+		if err != nil {
+			return errors.Wrap(err, "write")
+		}
+
+		n, err := c.Read(buf)
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+
+		if string(buf[:n]) != msg {
+			return errors.New("unexpected message: %q, expected %q", buf[:n], msg)
+		}
+	}
+
+	return nil
+}
+
+func BenchmarkListenerReadPacket(b *testing.B) {
+	tlog.DefaultLogger = nil
+
+	pc := &benchPacketConn{
+		addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000},
+		sid:  0x1234,
+		size: 1316,
+	}
+
+	l := newListener(pc)
+
+	c := l.newConn(pc.addr, &conndata{lid: pc.sid, mtu: l.MaxTransmissonUnit}, low.Monotonic())
+	l.register(c)
+
+	buf := make([]byte, pc.size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(pc.size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := l.readPacket()
+		if err != nil {
+			b.Fatalf("read packet: %v", err)
+		}
+
+		_, err = c.Read(buf)
+		if err != nil {
+			b.Fatalf("read: %v", err)
+		}
+	}
+}
+
+func (c *benchPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	dp := wire.DataPacket(p[:wire.Packet{}.MinSize()+c.size])
+
+	c.seq++
+
+	dp.SetSeq(c.seq)
+	dp.SetMsg(c.seq)
+	dp.SetSingle(true)
+	dp.SetOrdered(true)
+	wire.Packet(dp).SetSocketID(c.sid)
+
+	return len(dp), c.addr, nil
+}
+
+func (c *benchPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return len(p), nil
+}
+
+func BenchmarkLoopback(b *testing.B) {
+	tlog.DefaultLogger = nil
+
+	b.Run("plain", func(b *testing.B) { benchmarkLoopback(b, 0, InfiniteBW) })
+	b.Run("batch", func(b *testing.B) { benchmarkLoopback(b, 32, InfiniteBW) })
+	b.Run("paced", func(b *testing.B) { benchmarkLoopback(b, 0, 30_000_000) })
+	b.Run("paced_batch", func(b *testing.B) { benchmarkLoopback(b, 32, 30_000_000) })
+}
+
+func benchmarkLoopback(b *testing.B, batch int, maxbw int64) {
+	srv, err := Listen("udp", "127.0.0.1:0")
+	require.NoError(b, err)
+
+	defer srv.Close()
+
+	cl, err := Listen("udp", "127.0.0.1:0")
+	require.NoError(b, err)
+
+	defer cl.Close()
+
+	srv.SetBatchSize(batch)
+	cl.SetBatchSize(batch)
+	cl.MaxBW = maxbw
+
+	errc := make(chan error, 1)
+	msg := make([]byte, 16*1316)
+
+	go func() {
+		c, err := srv.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		defer c.Close()
+
+		buf := make([]byte, len(msg))
+
+		for i := 0; i < b.N; i++ {
+			_, err = c.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		errc <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := cl.Connect(ctx, srv.Addr())
+	require.NoError(b, err)
+
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err = c.Write(msg)
+		if err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+
+	err = <-errc
+	if err != nil {
+		b.Fatalf("read: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package srt
+
+import "github.com/nikandfor/srt/seqno"
+
+type (
+	lossList struct {
+		l []lossRange
+	}
+
+	lossRange struct {
+		from, to uint32
+
+		ts int64 // last reported
+	}
+)
+
+func (l *lossList) add(from, to uint32, ts int64) {
+	l.l = append(l.l, lossRange{from: from, to: to, ts: ts})
+}
+
+func (l *lossList) remove(seq uint32) {
+	for i := 0; i < len(l.l); i++ {
+		r := &l.l[i]
+
+		if seqno.Less(seq, r.from) || seqno.Less(r.to, seq) {
+			continue
+		}
+
+		switch {
+		case r.from == r.to:
+			copy(l.l[i:], l.l[i+1:])
+			l.l = l.l[:len(l.l)-1]
+		case seq == r.from:
+			r.from = seqno.Inc(r.from)
+		case seq == r.to:
+			r.to = seqno.Dec(r.to)
+		default:
+			tail := lossRange{from: seqno.Inc(seq), to: r.to, ts: r.ts}
+			r.to = seqno.Dec(seq)
+
+			l.l = append(l.l, lossRange{})
+			copy(l.l[i+2:], l.l[i+1:])
+			l.l[i+1] = tail
+		}
+
+		return
+	}
+}
+
+// due returns ranges not reported for interval and marks them as reported.
+func (l *lossList) due(now, interval int64, buf []lossRange) []lossRange {
+	for i := range l.l {
+		r := &l.l[i]
+
+		if now-r.ts < interval {
+			continue
+		}
+
+		r.ts = now
+
+		buf = append(buf, *r)
+	}
+
+	return buf
+}
+
+// removeTo removes all the losses up to seq inclusive.
+func (l *lossList) removeTo(seq uint32) {
+	j := 0
+
+	for _, r := range l.l {
+		if seqno.LessEq(r.to, seq) {
+			continue
+		}
+
+		if seqno.LessEq(r.from, seq) {
+			r.from = seqno.Inc(seq)
+		}
+
+		l.l[j] = r
+		j++
+	}
+
+	l.l = l.l[:j]
+}
+
+func (l *lossList) removeRange(from, to uint32) {
+	var split []lossRange
+
+	j := 0
+
+	for _, r := range l.l {
+		switch {
+		case seqno.Less(r.to, from) || seqno.Less(to, r.from):
+		case seqno.LessEq(from, r.from) && seqno.LessEq(r.to, to):
+			continue
+		case seqno.Less(r.from, from) && seqno.Less(to, r.to):
+			split = append(split, lossRange{from: seqno.Inc(to), to: r.to, ts: r.ts})
+			r.to = seqno.Dec(from)
+		case seqno.Less(r.from, from):
+			r.to = seqno.Dec(from)
+		default:
+			r.from = seqno.Inc(to)
+		}
+
+		l.l[j] = r
+		j++
+	}
+
+	l.l = append(l.l[:j], split...)
+}
@@ -0,0 +1,73 @@
+package srt
+
+import (
+	"sync"
+
+	"github.com/nikandfor/srt/wire"
+)
+
+type (
+	// packetPool is a free list of packet buffers.
+	// Zero value is ready to use, nil pool allocates every buffer.
+	packetPool struct {
+		mu   sync.Mutex
+		l    []wire.Packet
+		size int // max requested, all buffers are allocated that big
+	}
+)
+
+// packetPoolSize limits the number of idle buffers kept.
+const packetPoolSize = 1024
+
+// get returns zeroed buffer of size bytes.
+func (p *packetPool) get(size int) wire.Packet {
+	if p == nil {
+		return make(wire.Packet, size)
+	}
+
+	var b wire.Packet
+
+	p.mu.Lock()
+
+	if size > p.size {
+		p.size = size
+	}
+
+	if n := len(p.l); n != 0 {
+		b = p.l[n-1]
+		p.l[n-1] = nil
+		p.l = p.l[:n-1]
+	}
+
+	alloc := p.size
+
+	p.mu.Unlock()
+
+	if cap(b) < size {
+		return make(wire.Packet, size, alloc)
+	}
+
+	b = b[:size]
+
+	for i := range b {
+		b[i] = 0
+	}
+
+	return b
+}
+
+// put returns the buffer to the pool.
+// The buffer must not be used after that.
+func (p *packetPool) put(b wire.Packet) {
+	if p == nil || b == nil {
+		return
+	}
+
+	p.mu.Lock()
+
+	if len(p.l) < packetPoolSize {
+		p.l = append(p.l, b[:cap(b)])
+	}
+
+	p.mu.Unlock()
+}
@@ -0,0 +1,38 @@
+package srt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketPool(t *testing.T) {
+	var p packetPool
+
+	b := p.get(100)
+	assert.Len(t, b, 100)
+
+	b[0] = 1
+
+	p.put(b)
+
+	b = p.get(16)
+	assert.Len(t, b, 16)
+	assert.Equal(t, 100, cap(b), "reused")
+	assert.EqualValues(t, 0, b[0], "zeroed")
+
+	p.put(b)
+
+	b = p.get(200)
+	assert.Len(t, b, 200)
+
+	p.put(b)
+
+	assert.Equal(t, 200, cap(p.get(10)), "reused")
+	assert.Equal(t, 200, cap(p.get(10)), "allocated by max size")
+
+	var np *packetPool
+
+	assert.Len(t, np.get(10), 10)
+	np.put(b)
+}
@@ -4,77 +4,203 @@ import (
 	"io"
 	"sort"
 
+	"github.com/nikandfor/srt/seqno"
 	"github.com/nikandfor/srt/wire"
 	"github.com/nikandfor/tlog"
 )
 
 type (
+	// queue is a send buffer of unacknowledged packets.
 	queue struct {
-		seq uint32 // prev
+		seq uint32 // last sent
 
 		q []wire.DataPacket
+
+		base int64 // local time of the zero timestamp
+		ts   seqno.Timestamp
+	}
+
+	// recvQueue is a fixed capacity receive buffer.
+	// Packet is placed at its offset from the last delivered one.
+	recvQueue struct {
+		seq uint32 // last delivered
+
+		b []wire.DataPacket // ring, b[h] is for seq+1
+		h int
+		n int // packets in the buffer
+
+		window int // capacity, defaultRecvWindow if zero
+		eof    bool
+
+		pool *packetPool // delivered and discarded packets are returned to
+
+		latency int64 // TSBPD delay, disabled if zero
+		base    int64 // local time of the peer zero timestamp
+		ts      seqno.Timestamp
+
+		drop bool // too-late packet drop
 	}
 )
 
-func (q *queue) insert(p wire.DataPacket) {
-	q.q = append(q.q, p)
+const defaultRecvWindow = 0x2000
+
+func (q *recvQueue) size() int {
+	if q.b != nil {
+		return len(q.b)
+	}
+
+	if q.window != 0 {
+		return q.window
+	}
+
+	return defaultRecvWindow
+}
 
+func (q *recvQueue) at(off int) *wire.DataPacket {
+	return &q.b[(q.h+off)%len(q.b)]
+}
+
+// fits reports whether seq is not beyond the window.
+func (q *recvQueue) fits(seq uint32) bool {
+	return seqno.Offset(q.seq, seq) <= q.size()
+}
+
+// insert puts the packet to its place.
+// It returns false for duplicates and packets out of the window.
+// nil packet marks the end of stream.
+func (q *recvQueue) insert(p wire.DataPacket) bool {
 	if p == nil {
-		return
+		q.eof = true
+
+		return true
 	}
 
-	sort.Slice(q.q, func(i, j int) bool {
-		return q.q[i].Seq() < q.q[j].Seq()
-	})
+	if q.b == nil {
+		q.b = make([]wire.DataPacket, q.size())
+	}
+
+	off := seqno.Offset(q.seq, p.Seq()) - 1
+	if off < 0 || off >= len(q.b) {
+		return false
+	}
+
+	s := q.at(off)
+	if *s != nil {
+		return false
+	}
+
+	q.ts.Update(wire.Packet(p).RawTimestamp())
+
+	*s = p
+	q.n++
+
+	return true
 }
 
-func (q *queue) ack() (a uint32) {
-	a = q.seq
+// first returns the first buffered packet and its offset.
+func (q *recvQueue) first() (p wire.DataPacket, off int) {
+	if q.n == 0 {
+		return nil, -1
+	}
 
-	for _, p := range q.q {
-		if a+1 != p.Seq() {
-			break
+	for off = 0; ; off++ {
+		if p = *q.at(off); p != nil {
+			return p, off
 		}
+	}
+}
+
+// advance moves the head by n sequence numbers discarding packets passed.
+func (q *recvQueue) advance(n int) {
+	if q.b != nil {
+		for i := 0; i < n && q.n != 0; i++ {
+			s := q.at(i)
+
+			if *s != nil {
+				q.pool.put(wire.Packet(*s))
+
+				*s = nil
+				q.n--
+			}
+		}
+
+		q.h = (q.h + n) % len(q.b)
+	}
+
+	q.seq = seqno.Add(q.seq, n)
+}
+
+func (q *recvQueue) ack() (a uint32) {
+	a = q.seq
 
-		a++
+	for off := 0; off < q.n && *q.at(off) != nil; off++ {
+		a = seqno.Inc(a)
 	}
 
 	return a
 }
 
-func (q *queue) read(p []byte) (n int, err error) {
-	if len(q.q) == 0 {
+func (q *recvQueue) deliverAt(p wire.DataPacket) int64 {
+	return q.base + q.timestamp(p) + q.latency
+}
+
+// timestamp returns packet timestamp extended over 32-bit wraps.
+func (q *recvQueue) timestamp(p wire.DataPacket) int64 {
+	return q.ts.Extend(wire.Packet(p).RawTimestamp()) * 1000
+}
+
+// next returns time the first packet could be delivered
+// or dropped at if the previous ones are lost.
+// It's zero if TSBPD is disabled or there is no packet ready.
+func (q *recvQueue) next() int64 {
+	if q.latency == 0 {
+		return 0
+	}
+
+	p, off := q.first()
+	if p == nil || !q.drop && off != 0 {
+		return 0
+	}
+
+	return q.deliverAt(p)
+}
+
+func (q *recvQueue) read(p []byte, now int64) (n int, err error) {
+	if q.n == 0 {
+		if q.eof {
+			return 0, io.EOF
+		}
+
 		return 0, errWait
 	}
 
-	if q.q[0] == nil {
-		return 0, io.EOF
+	h := *q.at(0)
+
+	if tlog.If("queue") {
+		tlog.Printw("queue.read", "seq", tlog.Hex(q.seq), "qlen", q.n, "head", h != nil)
 	}
 
-	tlog.Printw("queue.read", "seq", tlog.Hex(q.seq), "qlen", len(q.q), "0.seq", tlog.Hex(q.q[0].Seq()), "0.first", q.q[0].First())
+	if h == nil || !h.First() {
+		return 0, errWait
+	}
 
-	if q.seq+1 != q.q[0].Seq() || !q.q[0].First() {
+	if q.latency != 0 && q.deliverAt(h) > now {
 		return 0, errWait
 	}
 
-	seq := q.seq
-	msg := q.q[0].Msg()
+	msg := h.Msg()
 
 	end := -1
-	for i := 0; i < len(q.q); i++ {
-		if seq+1 != q.q[i].Seq() {
-			return 0, errWait
-		}
-
-		if msg != q.q[i].Msg() {
+	for i := 0; i < q.n; i++ {
+		dp := *q.at(i)
+		if dp == nil || msg != dp.Msg() {
 			break
 		}
 
-		if q.q[i].Last() {
+		if dp.Last() {
 			end = i
+			break
 		}
-
-		seq++
 	}
 
 	if end == -1 {
@@ -84,19 +210,124 @@ func (q *queue) read(p []byte) (n int, err error) {
 	end++
 
 	for i := 0; i < end; i++ {
-		m := copy(p[n:], q.q[i].Data())
+		data := (*q.at(i)).Data()
+
+		m := copy(p[n:], data)
 		n += m
 
-		if m < len(q.q[i].Data()) {
+		if m < len(data) {
 			return n, ErrShortBuffer
 		}
 	}
 
-	copy(q.q, q.q[end:])
+	q.advance(end)
 
-	q.q = q.q[:len(q.q)-end]
+	return
+}
 
-	q.seq += uint32(end)
+// dropLate skips missing packets and incomplete messages
+// if the following packet is already due.
+func (q *recvQueue) dropLate(now int64) (dropped int) {
+	if !q.drop || q.latency == 0 {
+		return 0
+	}
 
-	return
+	for {
+		p, off := q.first()
+		if p == nil || q.deliverAt(p) > now {
+			break
+		}
+
+		if off != 0 {
+			q.advance(off)
+			dropped += off
+
+			continue
+		}
+
+		if p.First() {
+			break
+		}
+
+		q.advance(1)
+		dropped++
+	}
+
+	return dropped
+}
+
+// skip drops packets from first to last if they are at the head of the queue.
+func (q *recvQueue) skip(first, last uint32) (dropped int) {
+	if seqno.Less(seqno.Inc(q.seq), first) || seqno.LessEq(last, q.seq) {
+		return 0
+	}
+
+	dropped = seqno.Offset(q.seq, last)
+
+	q.advance(dropped)
+
+	return dropped
+}
+
+func (q *queue) push(p wire.DataPacket) {
+	q.q = append(q.q, p)
+}
+
+func (q *queue) release(ack uint32) (n int) {
+	for n < len(q.q) && seqno.Less(q.q[n].Seq(), ack) {
+		n++
+	}
+
+	q.shift(n)
+
+	return n
+}
+
+func (q *queue) timestamp(p wire.DataPacket) int64 {
+	return q.ts.Extend(wire.Packet(p).RawTimestamp()) * 1000
+}
+
+// expire removes packets sent before deadline.
+func (q *queue) expire(deadline int64) (d []wire.DataPacket) {
+	n := 0
+	for n < len(q.q) && q.base+q.timestamp(q.q[n]) < deadline {
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	d = append(d, q.q[:n]...)
+
+	q.shift(n)
+
+	return d
+}
+
+func (q *queue) shift(n int) {
+	if n == 0 {
+		return
+	}
+
+	copy(q.q, q.q[n:])
+
+	for i := len(q.q) - n; i < len(q.q); i++ {
+		q.q[i] = nil
+	}
+
+	q.q = q.q[:len(q.q)-n]
+}
+
+func (q *queue) span(from, to uint32) []wire.DataPacket {
+	i := sort.Search(len(q.q), func(i int) bool {
+		return seqno.LessEq(from, q.q[i].Seq())
+	})
+
+	j := i
+	for j < len(q.q) && seqno.LessEq(q.q[j].Seq(), to) {
+		j++
+	}
+
+	return q.q[i:j]
 }
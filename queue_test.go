@@ -0,0 +1,261 @@
+package srt
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nikandfor/srt/seqno"
+	"github.com/nikandfor/srt/wire"
+)
+
+func TestQueueTSBPD(t *testing.T) {
+	q := recvQueue{
+		seq:     9,
+		latency: int64(100 * time.Millisecond),
+		base:    int64(time.Second),
+	}
+
+	for i, ts := range []time.Duration{0, 10 * time.Millisecond} {
+		p := make(wire.DataPacket, 17)
+		p.SetSeq(10 + uint32(i))
+		p.SetMsg(1 + uint32(i))
+		p.SetSingle(true)
+		wire.Packet(p).SetTimestamp(int64(ts))
+		p.Data()[0] = byte('a' + i)
+
+		q.insert(p)
+	}
+
+	buf := make([]byte, 10)
+
+	assert.EqualValues(t, time.Second+100*time.Millisecond, q.next())
+
+	_, err := q.read(buf, int64(time.Second+99*time.Millisecond))
+	assert.Equal(t, errWait, err)
+
+	n, err := q.read(buf, int64(time.Second+100*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(buf[:n]))
+
+	assert.EqualValues(t, time.Second+110*time.Millisecond, q.next())
+
+	_, err = q.read(buf, int64(time.Second+105*time.Millisecond))
+	assert.Equal(t, errWait, err)
+
+	n, err = q.read(buf, int64(time.Second+120*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(buf[:n]))
+
+	assert.EqualValues(t, 0, q.next())
+}
+
+func TestQueueDropLate(t *testing.T) {
+	q := recvQueue{
+		seq:     9,
+		latency: int64(100 * time.Millisecond),
+		drop:    true,
+	}
+
+	for _, seq := range []uint32{12, 13} {
+		p := make(wire.DataPacket, 17)
+		p.SetSeq(seq)
+		p.SetMsg(seq)
+		p.SetSingle(true)
+		wire.Packet(p).SetTimestamp(int64(seq) * int64(time.Millisecond))
+
+		q.insert(p)
+	}
+
+	assert.EqualValues(t, 112*time.Millisecond, q.next())
+
+	assert.Equal(t, 0, q.dropLate(int64(111*time.Millisecond)))
+	assert.Equal(t, 2, q.dropLate(int64(112*time.Millisecond)))
+	assert.EqualValues(t, 11, q.seq)
+
+	buf := make([]byte, 10)
+
+	_, err := q.read(buf, int64(112*time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, q.skip(12, 16))
+	assert.EqualValues(t, 16, q.seq)
+	assert.Equal(t, 0, q.n)
+}
+
+func TestQueueWrap(t *testing.T) {
+	q := recvQueue{
+		seq:     seqno.Max - 1,
+		latency: int64(time.Millisecond),
+	}
+
+	for _, seq := range []uint32{0, seqno.Max, 1} {
+		p := make(wire.DataPacket, 17)
+		p.SetSeq(seq)
+		p.SetMsg(seq)
+		p.SetSingle(true)
+		p.Data()[0] = byte('a' + seqno.Offset(seqno.Max, seq))
+
+		wire.Packet(p).SetTimestamp(int64(0xffff_fff0+seqno.Offset(seqno.Max, seq)*0x10) * 1000)
+
+		assert.True(t, q.insert(p), "seq %x", seq)
+		assert.False(t, q.insert(p), "duplicate %x", seq)
+	}
+
+	assert.EqualValues(t, 1, q.ack())
+
+	buf := make([]byte, 10)
+	now := int64(time.Second)
+
+	for i, exp := range []string{"a", "b", "c"} {
+		assert.EqualValues(t, int64(i-1)*0x10*1000+q.latency, q.next(), "relative to the first inserted")
+
+		n, err := q.read(buf, now)
+		assert.NoError(t, err)
+		assert.Equal(t, exp, string(buf[:n]))
+	}
+
+	var l lossList
+
+	l.add(seqno.Max-1, 1, 0)
+	l.remove(0)
+	l.removeTo(seqno.Max - 1)
+
+	assert.Equal(t, []lossRange{{from: seqno.Max, to: seqno.Max}, {from: 1, to: 1}}, l.l)
+}
+
+func TestQueueWindow(t *testing.T) {
+	q := recvQueue{window: 4}
+
+	for _, seq := range []uint32{4, 2, 1, 3} {
+		p := make(wire.DataPacket, 17)
+		p.SetSeq(seq)
+		p.SetMsg(1)
+		p.SetFirst(seq == 1)
+		p.SetLast(seq == 4)
+
+		assert.True(t, q.insert(p), "seq %d", seq)
+	}
+
+	p := make(wire.DataPacket, 17)
+	p.SetSeq(5)
+
+	assert.False(t, q.fits(5))
+	assert.False(t, q.insert(p), "out of window")
+	assert.EqualValues(t, 4, q.ack())
+
+	buf := make([]byte, 10)
+
+	n, err := q.read(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 0, q.n)
+
+	assert.True(t, q.fits(5))
+	assert.True(t, q.insert(p), "window moved")
+	assert.False(t, q.insert(p), "duplicate")
+
+	q.insert(nil)
+
+	_, err = q.read(buf, 0)
+	assert.Equal(t, errWait, err, "incomplete message")
+
+	q.skip(5, 5)
+
+	_, err = q.read(buf, 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+// sliceQueue is the original sorted slice receive queue kept for comparison.
+// It appends and sorts the whole queue on every insert and shifts it on read.
+type sliceQueue struct {
+	seq uint32
+	q   []wire.DataPacket
+}
+
+func (q *sliceQueue) insert(p wire.DataPacket) bool {
+	q.q = append(q.q, p)
+
+	sort.Slice(q.q, func(i, j int) bool {
+		return q.q[i].Seq() < q.q[j].Seq()
+	})
+
+	return true
+}
+
+func (q *sliceQueue) read(p []byte) (n int, err error) {
+	if len(q.q) == 0 || seqno.Inc(q.seq) != q.q[0].Seq() {
+		return 0, errWait
+	}
+
+	n = copy(p, q.q[0].Data())
+
+	copy(q.q, q.q[1:])
+	q.q = q.q[:len(q.q)-1]
+
+	q.seq = seqno.Inc(q.seq)
+
+	return n, nil
+}
+
+func BenchmarkQueueRing(b *testing.B) {
+	q := recvQueue{window: 0x2000}
+
+	benchmarkQueue(b, q.insert, func(p []byte) (int, error) { return q.read(p, 0) })
+}
+
+func BenchmarkQueueSlice(b *testing.B) {
+	var q sliceQueue
+
+	benchmarkQueue(b, q.insert, q.read)
+}
+
+// benchmarkQueue inserts packets with reordering inside a window of 1000 packets
+// and reads them as soon as they are ready, keeping about 1000 packets in the queue.
+func benchmarkQueue(b *testing.B, insert func(wire.DataPacket) bool, read func([]byte) (int, error)) {
+	const reorder = 1000
+
+	ps := make([]wire.DataPacket, reorder)
+	for i := range ps {
+		ps[i] = make(wire.DataPacket, 16+1316)
+		ps[i].SetSingle(true)
+	}
+
+	seqs := make([]uint32, b.N+reorder)
+	for i := range seqs {
+		seqs[i] = uint32(i + 1)
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+
+	for i := 0; i+reorder <= len(seqs); i += reorder {
+		rnd.Shuffle(reorder, func(x, y int) {
+			seqs[i+x], seqs[i+y] = seqs[i+y], seqs[i+x]
+		})
+	}
+
+	buf := make([]byte, 1500)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p := ps[i%reorder]
+		p.SetSeq(seqs[i])
+
+		if !insert(p) {
+			b.Fatalf("insert %d failed", seqs[i])
+		}
+
+		for {
+			_, err := read(buf)
+			if err == errWait {
+				break
+			}
+		}
+	}
+}
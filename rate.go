@@ -0,0 +1,67 @@
+package srt
+
+import (
+	"time"
+
+	"github.com/nikandfor/srt/seqno"
+)
+
+type (
+	recvRate struct {
+		pkts  int
+		bytes int
+		start int64
+
+		pktRate  int // per second
+		byteRate int // per second
+
+		probe    int64 // arrival time of the first packet of probing pair
+		probeSeq uint32
+		capacity int // packets per second
+	}
+)
+
+const probeInterval = 16
+
+func (r *recvRate) add(seq uint32, size int, ts int64) {
+	if r.start == 0 {
+		r.start = ts
+	}
+
+	r.pkts++
+	r.bytes += size
+
+	switch {
+	case seq%probeInterval == 0:
+		r.probe = ts
+		r.probeSeq = seq
+	case seq%probeInterval == 1 && r.probe != 0 && seqno.Inc(r.probeSeq) == seq:
+		if d := ts - r.probe; d > 0 {
+			r.capacity = ewma(r.capacity, int(int64(time.Second)/d))
+		}
+
+		r.probe = 0
+	}
+}
+
+func (r *recvRate) update(now int64) {
+	d := now - r.start
+	if r.start == 0 || d < int64(synInterval) {
+		return
+	}
+
+	r.pktRate = ewma(r.pktRate, int(int64(r.pkts)*int64(time.Second)/d))
+	r.byteRate = ewma(r.byteRate, int(int64(r.bytes)*int64(time.Second)/d))
+
+	r.pkts = 0
+	r.bytes = 0
+	r.start = now
+}
+
+func ewma(v, x int) int {
+	if v == 0 {
+		return x
+	}
+
+	return (7*v + x) / 8
+}
@@ -0,0 +1,274 @@
+package srt
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
+
+	"github.com/nikandfor/srt/seqno"
+	"github.com/nikandfor/srt/wire"
+)
+
+const rendezvousInterval = 250 * time.Millisecond
+
+// Rendezvous connects to the peer which is doing the same to us at the same time.
+// The side with the bigger cookie becomes the initiator and proposes
+// connection parameters like a caller does, the other one responds like a listener.
+func (l *Listener) Rendezvous(ctx context.Context, addr net.Addr) (_ *Conn, err error) {
+	req := connreq{
+		id:     l.random(),
+		seq:    l.random(),
+		cookie: l.random(),
+		errc:   make(chan error, 1),
+	}
+
+	if l.Passphrase != "" {
+		req.crypto, err = newCrypter(l.cryptoMode(), l.keyLen())
+		if err != nil {
+			return nil, errors.Wrap(err, "init encryption")
+		}
+	}
+
+	k := key(addr, 0)
+
+	req.last = l.rendezvousHandshake(&req, wire.Wavehand)
+
+	l.mu.Lock()
+
+	if _, ok := l.rdv[k]; ok {
+		l.mu.Unlock()
+
+		return nil, errors.New("rendezvous is in progress: %v", addr)
+	}
+
+	l.rdv[k] = &req
+
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if l.rdv[k] == &req {
+			delete(l.rdv, k)
+		}
+	}()
+
+	tlog.Printw("rendezvous as", "socket_id", tlog.Hex(req.id), "addr", addr)
+
+	t := time.NewTicker(rendezvousInterval)
+	defer t.Stop()
+
+	for {
+		req.mu.Lock()
+		p := req.last
+		req.mu.Unlock()
+
+		_, err = l.WriteTo(p, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "send handshake")
+		}
+
+		select {
+		case err = <-req.errc:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-l.stopc:
+			return nil, net.ErrClosed
+		case <-t.C:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return req.c, nil
+	}
+}
+
+func (l *Listener) handleRendezvous(req *connreq, p wire.Handshake, addr net.Addr, ts int64) (err error) {
+	err = l.checkHandshake(p, addr, ts)
+	if err != nil {
+		return errors.Wrap(err, "check packet")
+	}
+
+	var hdr wire.Handshake
+	if p.Type() == wire.Conclusion {
+		hdr = append(hdr, p[:p.MinSize()]...)
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if hdr != nil {
+			l.reject(hdr, addr, err)
+		}
+
+		l.rendezvousDone(req, addr, nil, err)
+	}()
+
+	if ver := p.Version(); ver != 5 {
+		return rejectf(wire.RejVersion, "unsupported version: %x", ver)
+	}
+
+	if !req.resolved {
+		diff := int32(req.cookie - p.Cookie())
+		if diff == 0 {
+			return rejectf(wire.RejRendezvousCookie, "cookie contest draw")
+		}
+
+		req.peer = p.SocketID()
+		req.initiator = diff > 0
+		req.resolved = true
+
+		tlog.Printw("rendezvous role", "initiator", req.initiator, "peer_sid", tlog.Hex(req.peer))
+	}
+
+	d := conndata{
+		tp:  p.Type(),
+		ver: 5,
+	}
+
+	if d.tp == wire.Conclusion {
+		p, err = l.procExts(p, &d)
+		if err != nil {
+			return rejectf(wire.RejRogue, "extensions: %v", err)
+		}
+	}
+
+	switch {
+	case d.tp == wire.Wavehand, d.tp == wire.Conclusion && d.srtver == 0:
+		if !req.initiator {
+			return nil // wait for the initiator conclusion
+		}
+
+		return l.rendezvousConclusion(req, addr)
+	case d.tp == wire.Conclusion && !req.initiator: // initiator request
+		err = l.acceptCrypto(&d)
+		if err != nil {
+			return err
+		}
+	case d.tp == wire.Conclusion: // responder response
+		if req.crypto != nil && d.kmrsp == nil {
+			return rejectf(wire.RejUnsecure, "encryption is not supported by peer")
+		}
+
+		d.crypto = req.crypto
+		d.streamid = req.streamid
+	case d.tp == wire.Agreement:
+		return nil
+	default:
+		return errors.New("unexpected handshake: %x", d.tp)
+	}
+
+	d.lid = req.id
+	d.lseq = req.seq
+	d.rid = p.SocketID()
+	d.rseq = seqno.Dec(p.Seq())
+
+	d.mtu, err = l.negotiateMTU(p.MaxTransmissonUnit())
+	if err != nil {
+		return err
+	}
+
+	d.window = p.MaxFlowWindow()
+
+	c := l.newConn(addr, &d, ts)
+
+	if req.initiator {
+		c.hsrsp = l.rendezvousHandshake(req, wire.Agreement)
+	} else {
+		wire.Packet(p).SetSocketID(req.peer)
+
+		p.SetSocketID(req.id)
+		p.SetSeq(req.seq)
+		p.SetCookie(req.cookie)
+		p.SetEncryption(uint16(l.Encryption))
+		p.SetMaxTransmissionUnit(uint32(l.MaxTransmissonUnit))
+		p.SetMaxFlowWindow(uint32(l.MaxFlowWindow))
+
+		c.hsrsp = append(wire.Handshake{}, p...)
+	}
+
+	_, err = l.WriteTo(c.hsrsp, addr)
+	if err != nil {
+		return errors.Wrap(err, "send resp")
+	}
+
+	l.rendezvousDone(req, addr, c, nil)
+
+	return nil
+}
+
+// rendezvousConclusion switches the initiator from waving to proposing the connection.
+func (l *Listener) rendezvousConclusion(req *connreq, addr net.Addr) (err error) {
+	p := l.rendezvousHandshake(req, wire.Conclusion)
+
+	ext := uint16(wire.ExtFieldHSReq)
+
+	if req.crypto != nil {
+		ext |= wire.ExtFieldKMReq
+	}
+
+	if req.streamid != "" {
+		ext |= wire.ExtFieldConfig
+	}
+
+	p.SetExtensions(ext)
+
+	p, err = l.appendReqExts(p, req)
+	if err != nil {
+		return err
+	}
+
+	req.mu.Lock()
+	req.last = p
+	req.mu.Unlock()
+
+	_, err = l.WriteTo(p, addr)
+	if err != nil {
+		return errors.Wrap(err, "send conclusion")
+	}
+
+	return nil
+}
+
+func (l *Listener) rendezvousHandshake(req *connreq, tp int) (p wire.Handshake) {
+	p = l.newHandshake(tp, req.id)
+
+	wire.Packet(p).SetSocketID(req.peer)
+
+	p.SetSeq(req.seq)
+	p.SetCookie(req.cookie)
+	p.SetEncryption(uint16(l.Encryption))
+
+	return p
+}
+
+func (l *Listener) rendezvousDone(req *connreq, addr net.Addr, c *Conn, err error) {
+	k := key(addr, 0)
+
+	l.mu.Lock()
+
+	if l.rdv[k] == req {
+		delete(l.rdv, k)
+	}
+
+	l.mu.Unlock()
+
+	if c != nil {
+		l.register(c)
+
+		go c.loop()
+
+		req.c = c
+	}
+
+	req.done(err)
+}
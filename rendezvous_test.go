@@ -0,0 +1,162 @@
+package srt
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/tlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	testPipe struct {
+		net.PacketConn
+
+		local, peer testAddr
+
+		r, w chan []byte
+
+		stopc chan struct{}
+	}
+)
+
+func TestRendezvous(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	pa, pb := newTestPipe()
+
+	a := New(pa)
+	b := New(pb)
+
+	defer a.Close()
+	defer b.Close()
+
+	a.Passphrase = "rendezvous secret"
+	b.Passphrase = "rendezvous secret"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type res struct {
+		c   *Conn
+		err error
+	}
+
+	bc := make(chan res, 1)
+
+	go func() {
+		c, err := b.Rendezvous(ctx, pb.peer)
+		bc <- res{c: c, err: err}
+	}()
+
+	ca, err := a.Rendezvous(ctx, pa.peer)
+	require.NoError(t, err)
+
+	rb := <-bc
+	require.NoError(t, rb.err)
+
+	cb := rb.c
+
+	assert.Equal(t, ca.localid, cb.remoteid)
+	assert.Equal(t, cb.localid, ca.remoteid)
+	assert.NotNil(t, ca.crypto)
+	assert.NotNil(t, cb.crypto)
+
+	_, err = ca.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 100)
+
+	n, err := cb.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestListenerRotatesKeys(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	pa, pb := newTestPipe()
+
+	a := New(pa)
+	b := New(pb)
+
+	defer a.Close()
+	defer b.Close()
+
+	a.Passphrase = "secret"
+	b.Passphrase = "secret"
+
+	a.KeyRefreshRate = 8
+	a.KeyPreannounce = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cb, err := b.Connect(ctx, pb.peer)
+	require.NoError(t, err)
+
+	nc, err := a.Accept()
+	require.NoError(t, err)
+
+	ca := nc.(*Conn)
+
+	buf := make([]byte, 100)
+
+	for i := 0; i < 12; i++ {
+		_, err = ca.Write([]byte("feed"))
+		require.NoError(t, err)
+
+		n, err := cb.Read(buf)
+		require.NoError(t, err, "msg %d", i)
+		assert.Equal(t, "feed", string(buf[:n]), "msg %d", i)
+	}
+
+	ca.mu.Lock()
+	assert.True(t, ca.crypto.odd, "listener switched key")
+	ca.mu.Unlock()
+
+	cb.mu.Lock()
+	assert.NotNil(t, cb.rcrypto.blocks[1], "caller got the odd key")
+	cb.mu.Unlock()
+}
+
+func newTestPipe() (a, b *testPipe) {
+	x := make(chan []byte, 16)
+	y := make(chan []byte, 16)
+
+	a = &testPipe{local: "a", peer: "b", r: x, w: y, stopc: make(chan struct{}, 1)}
+	b = &testPipe{local: "b", peer: "a", r: y, w: x, stopc: make(chan struct{}, 1)}
+
+	return
+}
+
+func (c *testPipe) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case q := <-c.r:
+		return copy(p, q), c.peer, nil
+	case <-c.stopc:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *testPipe) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.stopc <- struct{}{}
+	}
+
+	return nil
+}
+
+func (c *testPipe) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.w <- append([]byte{}, p...)
+
+	return len(p), nil
+}
+
+func (c *testPipe) LocalAddr() net.Addr {
+	return c.local
+}
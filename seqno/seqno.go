@@ -0,0 +1,94 @@
+// Package seqno implements wrap-aware arithmetic on 31-bit packet sequence numbers
+// and 32-bit microsecond timestamps.
+package seqno
+
+const (
+	// Max is the maximum sequence number.
+	Max = 1<<31 - 1
+
+	mask = Max
+)
+
+// Inc returns the next sequence number.
+func Inc(s uint32) uint32 {
+	return (s + 1) & mask
+}
+
+// Dec returns the previous sequence number.
+func Dec(s uint32) uint32 {
+	return (s - 1) & mask
+}
+
+// Add returns s moved by n which may be negative.
+func Add(s uint32, n int) uint32 {
+	return (s + uint32(n)) & mask
+}
+
+// Offset returns signed number of steps from a to b.
+// It's positive if b is after a.
+func Offset(a, b uint32) int {
+	return int(int32((b-a)<<1) >> 1)
+}
+
+// Distance returns the number of sequence numbers in range from a to b inclusive.
+func Distance(a, b uint32) int {
+	return Offset(a, b) + 1
+}
+
+// Compare returns -1, 0 or 1 if a is before, equal to or after b.
+func Compare(a, b uint32) int {
+	switch d := Offset(b, a); {
+	case d < 0:
+		return -1
+	case d > 0:
+		return 1
+	}
+
+	return 0
+}
+
+// Less reports whether a is before b.
+func Less(a, b uint32) bool {
+	return Offset(a, b) > 0
+}
+
+// LessEq reports whether a is before b or equal to it.
+func LessEq(a, b uint32) bool {
+	return Offset(a, b) >= 0
+}
+
+// Timestamp extends 32-bit microsecond timestamps which wrap every ~71 minutes to int64.
+// Zero value is ready to use.
+type Timestamp struct {
+	last uint32
+	base int64
+	init bool
+}
+
+// Update accounts ts and returns it extended.
+func (t *Timestamp) Update(ts uint32) int64 {
+	if !t.init {
+		t.init = true
+		t.last = ts
+
+		return int64(ts)
+	}
+
+	x := t.Extend(ts)
+
+	if d := int32(ts - t.last); d > 0 {
+		t.base = x - int64(ts)
+		t.last = ts
+	}
+
+	return x
+}
+
+// Extend returns ts extended the nearest to the last updated one.
+func (t *Timestamp) Extend(ts uint32) int64 {
+	if !t.init {
+		return int64(ts)
+	}
+
+	return t.base + int64(t.last) + int64(int32(ts-t.last))
+}
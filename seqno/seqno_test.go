@@ -0,0 +1,44 @@
+package seqno
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeqno(t *testing.T) {
+	assert.EqualValues(t, 0, Inc(Max))
+	assert.EqualValues(t, Max, Dec(0))
+	assert.EqualValues(t, 2, Add(Max, 3))
+	assert.EqualValues(t, Max-1, Add(1, -3))
+
+	assert.Equal(t, 3, Offset(Max-1, 1))
+	assert.Equal(t, -3, Offset(1, Max-1))
+	assert.Equal(t, 4, Distance(Max-1, 1))
+
+	assert.True(t, Less(Max, 0))
+	assert.False(t, Less(0, Max))
+	assert.True(t, LessEq(5, 5))
+
+	assert.Equal(t, -1, Compare(Max, 0))
+	assert.Equal(t, 1, Compare(0, Max))
+	assert.Equal(t, 0, Compare(7, 7))
+}
+
+func TestTimestamp(t *testing.T) {
+	var ts Timestamp
+
+	assert.EqualValues(t, 0xffff_fff0, ts.Update(0xffff_fff0))
+	assert.EqualValues(t, 0x1_0000_0010, ts.Update(0x10))
+	assert.EqualValues(t, 0xffff_fff8, ts.Update(0xffff_fff8), "late packet from before the wrap")
+	assert.EqualValues(t, 0x1_0000_0020, ts.Extend(0x20))
+	assert.EqualValues(t, 0x2_0000_0010, func() int64 {
+		for x := uint32(0x10); x < 0xf000_0000; x += 0x1000_0000 {
+			ts.Update(x)
+		}
+
+		ts.Update(0xffff_ff00)
+
+		return ts.Update(0x10)
+	}())
+}
@@ -1,11 +1,16 @@
 package srt
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nikandfor/errors"
+	"github.com/nikandfor/srt/seqno"
 	"github.com/nikandfor/srt/wire"
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/low"
@@ -13,31 +18,183 @@ import (
 
 type (
 	Conn struct {
-		net.Conn
-
+		l    *Listener
 		p    net.PacketConn
 		addr net.Addr
 
 		localid  uint32
 		remoteid uint32
 
+		streamid string
+
 		epoch int64
 
+		hsrsp wire.Handshake // final handshake to repeat if peer didn't get it
+		hsv4  bool           // legacy peer, SRT options are negotiated by control messages
+
+		mtu     int
+		window  int // peer flow window
+		bufsize int
+
 		mu sync.Mutex
 
+		msg uint32
+
 		s queue
-		r queue
+		r recvQueue
+
+		pool *packetPool
+
+		batch   int // data packets sent at once
+		pending []wire.DataPacket
+
+		cc liveCC
+
+		last uint32 // highest received seq
+		loss lossList
+
+		sloss lossList // packets to retransmit
+
+		rtt    int64
+		rttVar int64
+
+		ackNum  uint32
+		ackSeq  uint32 // last seq sent in full ack
+		acks    [ackHistory]ackRecord
+		unacked int
+
+		lastAck int64 // last ack received or unacked packets resent
+
+		rate recvRate
+
+		slatency int64 // peer TSBPD delay
+		sdrop    bool
+
+		crypto  *crypter // our keys, used to send
+		rcrypto *crypter // peer keys, used to receive
+		pass    string
 
-		readnotify chan struct{}
+		kmRefresh int
+		kmPre     int
+		kmPending wire.KeyMaterial
+		kmSent    int64
+
+		stats Stats
+
+		lastRecv int64 // atomic
+		lastSent int64 // atomic
+		idle     int64 // peer idle timeout
+
+		err    error // connection is broken
+		closed bool
+		linger time.Duration
+
+		rdeadline time.Time
+		wdeadline time.Time
+
+		readnotify  chan struct{}
+		writenotify chan struct{}
+
+		stopc chan struct{}
+	}
+
+	Stats struct {
+		SendDropped int // too late to send packets
+		SendSkipped int // retransmissions postponed over the bandwidth overhead
+		RecvDropped int // too late to deliver packets
+
+		RecvDiscarded   int // duplicate and out of window packets
+		RecvUndecrypted int // packets failed to decrypt or authenticate or not encrypted at all
+	}
+
+	// RejectError is the handshake rejection reason.
+	// It's returned from Listener.Connect if the peer rejected the connection.
+	// Listener.AcceptFilter returns it to reject the caller with the Reason.
+	RejectError struct {
+		Reason int
+	}
+
+	timeoutError string
+
+	ackRecord struct {
+		num uint32
+		ts  int64
 	}
 )
 
 var ErrShortBuffer = io.ErrShortBuffer
 
+var _ net.Conn = &Conn{}
+
 var errWait = errors.New("wait")
 
+// ErrPeerIdleTimeout is returned when nothing came from the peer for too long.
+var ErrPeerIdleTimeout error = timeoutError("peer idle timeout")
+
+// ErrPeerClosed is returned from Write after the peer has shut down the connection.
+var ErrPeerClosed = errors.New("closed by peer")
+
+var rejectReasons = []string{
+	wire.RejUnknown:          "unknown",
+	wire.RejSystem:           "system",
+	wire.RejPeer:             "peer",
+	wire.RejResource:         "resource",
+	wire.RejRogue:            "rogue",
+	wire.RejBacklog:          "backlog",
+	wire.RejInternal:         "internal",
+	wire.RejClose:            "closed",
+	wire.RejVersion:          "version",
+	wire.RejRendezvousCookie: "rendezvous cookie",
+	wire.RejBadSecret:        "bad secret",
+	wire.RejUnsecure:         "unsecure",
+	wire.RejMessageAPI:       "message api",
+	wire.RejCongestion:       "congestion",
+	wire.RejFilter:           "filter",
+	wire.RejGroup:            "group",
+	wire.RejTimeout:          "timeout",
+	wire.RejCrypto:           "crypto",
+}
+
 const mtuHeaders = 6 * 4 // 2 * 4 udp + 4 * 4 srt data header
 
+// minMTU leaves room for headers, crypto overhead and some payload.
+const minMTU = 76
+
+const maxStreamIDLen = 512
+
+const (
+	synInterval = 10 * time.Millisecond
+	nakInterval = 20 * time.Millisecond
+
+	defaultRTT = 100 * time.Millisecond
+
+	keepaliveInterval = time.Second
+
+	// keyMaterialTimeout is how long legacy peer may take to send keys
+	// when encryption is required.
+	keyMaterialTimeout = 3 * time.Second
+
+	lightAckPackets = 64
+	ackHistory      = 32
+)
+
+func (e *RejectError) Error() string {
+	if e.Reason >= 0 && e.Reason < len(rejectReasons) {
+		return "rejected: " + rejectReasons[e.Reason]
+	}
+
+	return fmt.Sprintf("rejected: %d", e.Reason)
+}
+
+// rejectf is an error which rejects the peer with the reason.
+func rejectf(reason int, f string, args ...interface{}) error {
+	return errors.WrapDepth(&RejectError{Reason: reason}, 1, f, args...)
+}
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.p.LocalAddr()
 }
@@ -46,18 +203,179 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.addr
 }
 
+// StreamID is the stream requested by the caller.
+func (c *Conn) StreamID() string {
+	return c.streamid
+}
+
 func (c *Conn) Write(p []byte) (n int, err error) {
-	// TODO
-	tlog.Printw("write")
-	return
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	// legacy peer sends keys after the handshake, don't send plaintext until then
+	for c.hsv4 && c.pass != "" && c.crypto == nil {
+		dl := c.wdeadline
+
+		c.mu.Unlock()
+		err = wait(c.writenotify, 0, dl)
+		c.mu.Lock()
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	size := c.mtu - mtuHeaders
+
+	overhead := 0
+	if c.crypto != nil {
+		overhead = c.crypto.overhead()
+		size -= overhead
+	}
+
+	c.msg = (c.msg + 1) & 0x3ff_ffff
+	if c.msg == 0 {
+		c.msg = 1
+	}
+
+	c.cc.input(len(p), low.Monotonic())
+
+	for n < len(p) {
+		m := len(p) - n
+		if m > size {
+			m = size
+		}
+
+		for c.window != 0 && len(c.s.q) >= c.window {
+			err = c.flush()
+			if err != nil {
+				return n, errors.Wrap(err, "send data")
+			}
+
+			dl := c.wdeadline
+
+			c.mu.Unlock()
+			err = wait(c.writenotify, 0, dl)
+			c.mu.Lock()
+
+			if c.err != nil {
+				return n, c.err
+			}
+
+			if err != nil {
+				return n, err
+			}
+		}
+
+		for len(c.pending) == 0 {
+			d := c.cc.delay(low.Monotonic())
+			if d <= 0 {
+				break
+			}
+
+			dl := c.wdeadline
+
+			c.mu.Unlock()
+			err = wait(c.writenotify, d, dl)
+			c.mu.Lock()
+
+			if c.err != nil {
+				return n, c.err
+			}
+
+			if err != nil {
+				return n, err
+			}
+		}
+
+		dp := make(wire.DataPacket, wire.Packet{}.MinSize()+m+overhead)
+
+		c.s.seq = seqno.Inc(c.s.seq)
+
+		dp.SetSeq(c.s.seq)
+		dp.SetMsg(c.msg)
+		dp.SetFirst(n == 0)
+		dp.SetLast(n+m == len(p))
+		dp.SetOrdered(true)
+
+		copy(dp.Data(), p[n:])
+
+		if c.crypto != nil {
+			c.crypto.encrypt(dp)
+		}
+
+		c.s.push(dp)
+
+		c.pending = append(c.pending, dp)
+
+		if len(c.pending) >= c.batch {
+			err = c.flush()
+			if err != nil {
+				return n, errors.Wrap(err, "send data")
+			}
+		}
+
+		if c.crypto != nil {
+			err = c.rotateKey()
+			if err != nil {
+				return n, errors.Wrap(err, "rotate key")
+			}
+		}
+
+		n += m
+	}
+
+	err = c.flush()
+	if err != nil {
+		return n, errors.Wrap(err, "send data")
+	}
+
+	tlog.V("write").Printw("write", "n", n, "msg", c.msg, "seq", tlog.Hex(c.s.seq))
+
+	return n, nil
 }
 
 func (c *Conn) Read(p []byte) (n int, err error) {
 again:
-	n, err = c.r.read(p)
-	tlog.Printw("read", "n", n, "err", err)
+	now := low.Monotonic()
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+
+		return 0, net.ErrClosed
+	}
+
+	c.dropLate(now)
+
+	n, err = c.r.read(p, now)
+	next := c.r.next()
+
+	if err == errWait && c.err != nil {
+		err = c.err
+	}
+
+	dl := c.rdeadline
+
+	c.mu.Unlock()
+
+	if tlog.If("read") {
+		tlog.Printw("read", "n", n, "err", err)
+	}
 	if err == errWait {
-		<-c.readnotify
+		err = wait(c.readnotify, next-now, dl)
+		if err != nil {
+			return 0, err
+		}
 
 		goto again
 	}
@@ -65,23 +383,188 @@ again:
 	return
 }
 
+// wait blocks until notified or for d nanoseconds if it's positive.
+// It fails if the deadline is exceeded.
+func wait(notify chan struct{}, d int64, deadline time.Time) (err error) {
+	if !deadline.IsZero() {
+		dd := time.Until(deadline)
+		if dd <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		if d <= 0 || int64(dd) < d {
+			d = int64(dd)
+		}
+	}
+
+	if d <= 0 {
+		<-notify
+
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(d))
+	defer t.Stop()
+
+	select {
+	case <-notify:
+	case <-t.C:
+	}
+
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.wdeadline = t
+	c.mu.Unlock()
+
+	notify(c.readnotify)
+	notify(c.writenotify)
+
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+
+	notify(c.readnotify)
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+
+	notify(c.writenotify)
+
+	return nil
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// recv handles the packet. It takes ownership of the buffer
+// and returns it to the pool once it's processed.
 func (c *Conn) recv(p wire.Packet, addr net.Addr, ts int64) (err error) {
+	atomic.StoreInt64(&c.lastRecv, ts)
+
 	if p.Control() {
-		return c.recvControl(p, addr, ts)
+		err = c.recvControl(p, addr, ts)
+
+		if tp, _ := p.ControlType(); tp != wire.UserDefinedType {
+			c.pool.put(p)
+		}
+
+		return err
 	}
 
 	dp := wire.DataPacket(p)
+	seq := dp.Seq()
 
-	c.r.insert(dp)
+	if dp.Encrypted() {
+		if c.rcrypto == nil {
+			c.pool.put(p)
 
-	select {
-	case c.readnotify <- struct{}{}:
+			return errors.New("encrypted packet on unencrypted connection")
+		}
+
+		c.mu.Lock()
+
+		dp, err = c.rcrypto.decrypt(dp)
+		if err != nil {
+			c.stats.RecvUndecrypted++
+		}
+
+		c.mu.Unlock()
+
+		if err != nil {
+			c.pool.put(p)
+
+			return errors.Wrap(err, "decrypt")
+		}
+	} else if c.pass != "" {
+		c.mu.Lock()
+		c.stats.RecvUndecrypted++
+		c.mu.Unlock()
+
+		c.pool.put(p)
+
+		return errors.New("unencrypted packet on encrypted connection")
+	}
+
+	var lost lossRange
+	var gap bool
+
+	c.mu.Lock()
+
+	if !c.r.fits(seq) {
+		c.stats.RecvDiscarded++
+		c.mu.Unlock()
+
+		c.pool.put(p)
+
+		tlog.V("drop").Printw("out of window", "seq", tlog.Hex(seq), "delivered", tlog.Hex(c.r.seq))
+
+		return nil
+	}
+
+	switch {
+	case seqno.Less(seqno.Inc(c.last), seq):
+		lost = lossRange{from: seqno.Inc(c.last), to: seqno.Dec(seq), ts: ts}
+		gap = true
+
+		c.loss.add(lost.from, lost.to, ts)
+		c.last = seq
+	case seq == seqno.Inc(c.last):
+		c.last = seq
 	default:
+		c.loss.remove(seq)
 	}
 
-	err = c.lightAck()
-	if err != nil {
-		return errors.Wrap(err, "send ack")
+	if c.r.latency != 0 && c.r.base == 0 {
+		c.r.base = ts - c.r.timestamp(dp)
+	}
+
+	c.rate.add(seq, len(dp.Data()), ts)
+
+	if !c.r.insert(dp) {
+		c.stats.RecvDiscarded++
+		c.pool.put(p)
+	}
+
+	c.unacked++
+	light := c.unacked >= lightAckPackets
+
+	if light {
+		c.unacked = 0
+	}
+
+	c.mu.Unlock()
+
+	notify(c.readnotify)
+
+	if gap {
+		err = c.sendNak([]lossRange{lost})
+		if err != nil {
+			return errors.Wrap(err, "send nak")
+		}
+	}
+
+	if light {
+		err = c.lightAck()
+		if err != nil {
+			return errors.Wrap(err, "send ack")
+		}
 	}
 
 	return
@@ -92,12 +575,18 @@ func (c *Conn) recvControl(p wire.Packet, addr net.Addr, ts int64) (err error) {
 
 	switch tp {
 	case wire.ShutdownType:
-		c.r.insert(nil)
-
-		select {
-		case c.readnotify <- struct{}{}:
-		default:
-		}
+		c.shutdown()
+	case wire.AckType:
+		err = c.recvAck(wire.Ack(p), ts)
+	case wire.NakType:
+		err = c.recvNak(wire.Nak(p))
+	case wire.AckAckType:
+		err = c.recvAckAck(p, ts)
+	case wire.DropReqType:
+		err = c.recvDropReq(wire.DropReq(p))
+	case wire.UserDefinedType:
+		err = c.recvUserDefined(p)
+	case wire.KeepAliveType:
 	default:
 		tlog.Printw("control", "tp", tp)
 	}
@@ -105,40 +594,804 @@ func (c *Conn) recvControl(p wire.Packet, addr net.Addr, ts int64) (err error) {
 	return
 }
 
-func (c *Conn) lightAck() (err error) {
-	p := make(wire.Ack, wire.Ack{}.MinSize())
+func (c *Conn) recvAck(p wire.Ack, ts int64) (err error) {
+	if len(p) < p.MinSize() {
+		return errors.New("short ack")
+	}
 
-	n := c.r.ack()
+	seq := p.Seq()
 
-	defer func() {
-		tlog.Printw("ack", "ack", tlog.Hex(n), "err", err)
-	}()
+	c.mu.Lock()
 
-	p.SetAckNum(n + 1)
+	n := c.s.release(seq)
+	if n != 0 {
+		c.lastAck = ts
+	}
 
-	wire.Packet(p).SetControlType(wire.AckType, 0)
+	if p.Full() && p.RTT() != 0 {
+		c.rtt = int64(p.RTT())
+		c.rttVar = int64(p.RTTVar())
+	}
 
-	return c.sendControl(wire.Packet(p))
+	c.mu.Unlock()
+
+	tlog.V("ack").Printw("recv ack", "num", p.AckNum(), "seq", tlog.Hex(seq), "released", n)
+
+	if n != 0 {
+		notify(c.writenotify)
+	}
+
+	if num := p.AckNum(); num != 0 {
+		err = c.sendAckAck(num)
+		if err != nil {
+			return errors.Wrap(err, "send ackack")
+		}
+	}
+
+	return nil
 }
 
-func (c *Conn) sendControl(p wire.Packet) (err error) {
-	p.SetTimestamp(low.Monotonic() - c.epoch)
-	p.SetSocketID(c.remoteid)
+func (c *Conn) recvAckAck(p wire.Packet, ts int64) (err error) {
+	num := p.TypeSpecific()
 
-	_, err = c.p.WriteTo(p, c.addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return errors.Wrap(err, "write")
+	a := c.acks[num%ackHistory]
+	if a.num != num || a.ts == 0 {
+		return nil
+	}
+
+	c.updateRTT(ts - a.ts)
+
+	tlog.V("rtt").Printw("rtt", "sample", time.Duration(ts-a.ts), "rtt", time.Duration(c.rtt), "var", time.Duration(c.rttVar))
+
+	return nil
 }
 
-func (c *Conn) Close() (err error) {
-	p := make(wire.Packet, wire.Packet{}.MinSize())
+func (c *Conn) recvUserDefined(p wire.Packet) (err error) {
+	_, sub := p.ControlType()
 
-	p.SetControlType(wire.ShutdownType, 0)
+	km := wire.KeyMaterial(p[p.MinSize():])
 
-	err = c.sendControl(p)
-	if err != nil {
-		return errors.Wrap(err, "send shutdown packet")
+	switch sub {
+	case wire.HSReqExt:
+		if !c.hsv4 {
+			return errors.New("handshake request on established connection")
+		}
+
+		return c.recvHSReq(p[p.MinSize():])
+	case wire.KMReqExt:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		switch {
+		case c.rcrypto != nil:
+			err = c.rcrypto.update(km, c.pass)
+		case c.hsv4 && c.pass != "":
+			c.rcrypto, err = parseKeyMaterial(km, c.pass)
+			if err == nil {
+				c.crypto = c.rcrypto.clone()
+
+				notify(c.writenotify)
+			}
+		default:
+			return errors.New("key material on unencrypted connection")
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "update keys")
+		}
+
+		tlog.V("crypto").Printw("keys updated", "keys", km.Keys())
+
+		return c.sendKeyMaterial(wire.KMRspExt, km)
+	case wire.KMRspExt:
+		if !km.Valid() {
+			return errors.New("bad key material response")
+		}
+
+		c.mu.Lock()
+		c.kmPending = nil
+		c.mu.Unlock()
+
+		tlog.V("crypto").Printw("keys confirmed", "keys", km.Keys())
+	default:
+		tlog.Printw("user defined control", "sub", sub)
 	}
 
 	return nil
 }
+
+// recvHSReq negotiates SRT options with legacy peer.
+func (c *Conn) recvHSReq(body []byte) (err error) {
+	size := wire.HandshakeExt{}.Size()
+
+	if len(body) < size-4 {
+		return errors.New("short handshake request")
+	}
+
+	e := make(wire.Ext, size)
+	e.SetHeader(wire.HSRspExt, size)
+	copy(e[4:], body)
+
+	var d conndata
+
+	c.l.negotiate(wire.HandshakeExt(e), &d, false)
+
+	c.mu.Lock()
+	c.l.setupConn(c, &d)
+	c.mu.Unlock()
+
+	tlog.Printw("legacy handshake", "flags", tlog.Hex(d.pflags), "rlatency", time.Duration(d.rlatency), "slatency", time.Duration(d.slatency))
+
+	p := make(wire.Packet, wire.Packet{}.MinSize()+size-4)
+
+	p.SetControlType(wire.UserDefinedType, wire.HSRspExt)
+	copy(p[p.MinSize():], e[4:])
+
+	return c.sendControl(p)
+}
+
+// rotateKey is called with c.mu held.
+func (c *Conn) rotateKey() (err error) {
+	keys, err := c.crypto.rotate(c.kmRefresh, c.kmPre)
+	if err != nil || keys == 0 {
+		return err
+	}
+
+	km, err := c.crypto.keyMaterial(c.pass, keys)
+	if err != nil {
+		return errors.Wrap(err, "key material")
+	}
+
+	tlog.V("crypto").Printw("announce keys", "keys", keys, "odd", c.crypto.odd)
+
+	c.kmPending = km
+	c.kmSent = low.Monotonic()
+
+	return c.sendKeyMaterial(wire.KMReqExt, km)
+}
+
+func (c *Conn) sendKeyMaterial(sub uint16, km wire.KeyMaterial) (err error) {
+	p := make(wire.Packet, wire.Packet{}.MinSize()+len(km))
+
+	p.SetControlType(wire.UserDefinedType, sub)
+	copy(p[p.MinSize():], km)
+
+	return c.sendControl(p)
+}
+
+func (c *Conn) recvDropReq(p wire.DropReq) (err error) {
+	if len(p) < p.MinSize() {
+		return errors.New("short drop request")
+	}
+
+	first, last := p.First(), p.Last()
+
+	c.mu.Lock()
+
+	c.loss.removeRange(first, last)
+
+	// don't report the dropped packets lost when the next one comes
+	if seqno.Less(c.last, last) {
+		c.last = last
+	}
+
+	n := c.r.skip(first, last)
+	c.stats.RecvDropped += n
+
+	c.mu.Unlock()
+
+	tlog.V("drop").Printw("recv drop request", "msg", p.Msg(), "first", tlog.Hex(first), "last", tlog.Hex(last), "dropped", n)
+
+	if n != 0 {
+		notify(c.readnotify)
+	}
+
+	return nil
+}
+
+// dropLate is called with c.mu held.
+func (c *Conn) dropLate(now int64) {
+	n := c.r.dropLate(now)
+	if n == 0 {
+		return
+	}
+
+	c.loss.removeTo(c.r.seq)
+	c.stats.RecvDropped += n
+
+	tlog.V("drop").Printw("drop too late", "seq", tlog.Hex(c.r.seq), "dropped", n)
+}
+
+func (c *Conn) dropThreshold() int64 {
+	d := c.slatency
+	if d < int64(time.Second) {
+		d = int64(time.Second)
+	}
+
+	return d + 2*int64(synInterval)
+}
+
+func (c *Conn) updateRTT(sample int64) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+
+		return
+	}
+
+	d := c.rtt - sample
+	if d < 0 {
+		d = -d
+	}
+
+	c.rttVar = (3*c.rttVar + d) / 4
+	c.rtt = (7*c.rtt + sample) / 8
+}
+
+func (c *Conn) nakPeriod() int64 {
+	d := c.rtt + 4*c.rttVar
+
+	if d < int64(nakInterval) {
+		d = int64(nakInterval)
+	}
+
+	return d
+}
+
+func (c *Conn) recvNak(p wire.Nak) (err error) {
+	if len(p) < p.MinSize() {
+		return errors.New("short nak")
+	}
+
+	c.mu.Lock()
+
+	for st := p.LossStart(); st < len(p); {
+		from, to, next := p.Loss(st)
+		if next == -1 {
+			c.mu.Unlock()
+
+			return errors.New("bad loss list at %x", st)
+		}
+
+		tlog.V("nak").Printw("recv nak", "from", tlog.Hex(from), "to", tlog.Hex(to))
+
+		c.sloss.removeRange(from, to)
+		c.sloss.add(from, to, 0)
+
+		st = next
+	}
+
+	c.mu.Unlock()
+
+	return c.sendLost(low.Monotonic())
+}
+
+func (c *Conn) lightAck() (err error) {
+	p := wire.Ack(c.pool.get(wire.Ack{}.MinSize()))
+	defer c.pool.put(wire.Packet(p))
+
+	c.mu.Lock()
+	seq := seqno.Inc(c.r.ack())
+	c.mu.Unlock()
+
+	defer func() {
+		tlog.V("ack").Printw("light ack", "seq", tlog.Hex(seq), "err", err)
+	}()
+
+	p.SetSeq(seq)
+
+	wire.Packet(p).SetControlType(wire.AckType, 0)
+
+	return c.sendControl(wire.Packet(p))
+}
+
+func (c *Conn) fullAck(now int64) (err error) {
+	p := wire.Ack(c.pool.get(wire.Ack{}.FullSize()))
+	defer c.pool.put(wire.Packet(p))
+
+	c.mu.Lock()
+
+	seq := seqno.Inc(c.r.ack())
+
+	if seq == c.ackSeq && now-c.acks[c.ackNum%ackHistory].ts < c.nakPeriod() {
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	c.ackNum++
+	c.ackSeq = seq
+	c.acks[c.ackNum%ackHistory] = ackRecord{num: c.ackNum, ts: now}
+	c.unacked = 0
+
+	c.rate.update(now)
+
+	buf := c.bufsize - c.r.n
+	if buf < 0 {
+		buf = 0
+	}
+
+	p.SetAckNum(c.ackNum)
+	p.SetSeq(seq)
+	p.SetRTT(time.Duration(c.rtt))
+	p.SetRTTVar(time.Duration(c.rttVar))
+	p.SetBuffer(buf)
+	p.SetPacketRecvRate(c.rate.pktRate)
+	p.SetLinkCapacity(c.rate.capacity)
+	p.SetRecvRate(c.rate.byteRate)
+
+	c.mu.Unlock()
+
+	tlog.V("ack").Printw("full ack", "num", p.AckNum(), "seq", tlog.Hex(seq))
+
+	wire.Packet(p).SetControlType(wire.AckType, 0)
+
+	return c.sendControl(wire.Packet(p))
+}
+
+func (c *Conn) sendAckAck(num uint32) (err error) {
+	p := c.pool.get(wire.Packet{}.MinSize())
+	defer c.pool.put(p)
+
+	p.SetControlType(wire.AckAckType, 0)
+	p.SetTypeSpecific(num)
+
+	return c.sendControl(p)
+}
+
+func (c *Conn) sendNak(l []lossRange) (err error) {
+	size := c.mtu - mtuHeaders + wire.Packet{}.MinSize()
+
+	p := c.pool.get(size)[:wire.Packet{}.MinSize()]
+	defer c.pool.put(p)
+
+	p.SetControlType(wire.NakType, 0)
+
+	for _, r := range l {
+		if len(p)+8 > size {
+			break
+		}
+
+		p = wire.AppendLoss(p, r.from, r.to)
+	}
+
+	tlog.V("nak").Printw("send nak", "ranges", len(l), "size", len(p))
+
+	return c.sendControl(p)
+}
+
+func (c *Conn) loop() {
+	t := time.NewTicker(synInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stopc:
+			return
+		case <-t.C:
+		}
+
+		err := c.timers(low.Monotonic())
+		if err != nil {
+			tlog.Printw("timers", "err", err)
+		}
+	}
+}
+
+func (c *Conn) timers(now int64) (err error) {
+	if c.idle != 0 && now-atomic.LoadInt64(&c.lastRecv) > c.idle {
+		tlog.Printw("peer idle timeout", "local_sid", tlog.Hex(c.localid), "idle", time.Duration(now-atomic.LoadInt64(&c.lastRecv)))
+
+		return c.abort(ErrPeerIdleTimeout)
+	}
+
+	if c.hsv4 && c.pass != "" && now-c.epoch > int64(keyMaterialTimeout) {
+		c.mu.Lock()
+		nokeys := c.rcrypto == nil
+		c.mu.Unlock()
+
+		if nokeys {
+			tlog.Printw("no key material from legacy peer", "local_sid", tlog.Hex(c.localid))
+
+			return c.abort(&RejectError{Reason: wire.RejUnsecure})
+		}
+	}
+
+	err = c.fullAck(now)
+	if err != nil {
+		return errors.Wrap(err, "send ack")
+	}
+
+	var expired []wire.DataPacket
+	var km wire.KeyMaterial
+
+	c.mu.Lock()
+
+	c.dropLate(now)
+
+	if c.kmPending != nil && now-c.kmSent >= c.nakPeriod() {
+		km = c.kmPending
+		c.kmSent = now
+	}
+
+	nak := c.loss.due(now, c.nakPeriod(), nil)
+
+	if c.sdrop {
+		expired = c.s.expire(now - c.dropThreshold())
+		c.stats.SendDropped += len(expired)
+	}
+
+	c.mu.Unlock()
+
+	if len(nak) != 0 {
+		err = c.sendNak(nak)
+		if err != nil {
+			return errors.Wrap(err, "send nak")
+		}
+	}
+
+	if km != nil {
+		err = c.sendKeyMaterial(wire.KMReqExt, km)
+		if err != nil {
+			return errors.Wrap(err, "resend key material")
+		}
+	}
+
+	if len(expired) != 0 {
+		notify(c.writenotify)
+
+		err = c.sendDropReqs(expired)
+		if err != nil {
+			return errors.Wrap(err, "send drop request")
+		}
+	}
+
+	c.resendUnacked(now)
+
+	err = c.sendLost(now)
+	if err != nil {
+		return errors.Wrap(err, "send lost")
+	}
+
+	err = c.keepalive(now)
+	if err != nil {
+		return errors.Wrap(err, "send keepalive")
+	}
+
+	return nil
+}
+
+// resendUnacked schedules all the unacknowledged packets for retransmission if no ack came for too long.
+// The receiver can't detect the tail of transmission is lost so it's up to the sender.
+func (c *Conn) resendUnacked(now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.s.q) == 0 {
+		return
+	}
+
+	last := c.lastAck
+	if sent := c.epoch + c.s.timestamp(c.s.q[0]); sent > last {
+		last = sent
+	}
+
+	if now-last < c.rexmitTimeout() {
+		return
+	}
+
+	c.lastAck = now
+
+	from, to := c.s.q[0].Seq(), c.s.q[len(c.s.q)-1].Seq()
+
+	tlog.V("nak").Printw("ack timeout", "from", tlog.Hex(from), "unacked", len(c.s.q))
+
+	c.sloss.removeRange(from, to)
+	c.sloss.add(from, to, 0)
+}
+
+// sendLost retransmits lost packets as long as pacing and the overhead allow.
+// The rest is sent later by timers.
+func (c *Conn) sendLost(now int64) (err error) {
+	var ps []wire.DataPacket
+
+	c.mu.Lock()
+
+	for len(c.sloss.l) != 0 {
+		r := c.sloss.l[0]
+
+		span := c.s.span(r.from, r.to)
+		if len(span) == 0 { // acked or dropped
+			c.sloss.removeRange(r.from, r.to)
+			continue
+		}
+
+		dp := span[0]
+
+		if !c.cc.due(now) {
+			break
+		}
+
+		if !c.cc.rexmit(len(dp), now) {
+			c.stats.SendSkipped++
+			break
+		}
+
+		c.sloss.removeRange(r.from, dp.Seq())
+
+		if !dp.Retransmitted() {
+			dp.SetRetransmitted(true)
+		}
+
+		ps = append(ps, dp)
+	}
+
+	c.mu.Unlock()
+
+	if len(ps) == 0 {
+		return nil
+	}
+
+	if s, ok := c.p.(sender); ok {
+		err = s.writeBatch(ps, c.addr)
+
+		return errors.Wrap(err, "retransmit")
+	}
+
+	for _, dp := range ps {
+		_, err = c.p.WriteTo(dp, c.addr)
+		if err != nil {
+			return errors.Wrap(err, "retransmit")
+		}
+	}
+
+	return nil
+}
+
+func (c *Conn) rexmitTimeout() int64 {
+	return 4*c.rtt + c.rttVar + int64(synInterval)
+}
+
+func (c *Conn) sendDropReqs(d []wire.DataPacket) (err error) {
+	for i := 0; i < len(d); {
+		j := i + 1
+		for j < len(d) && d[j].Msg() == d[i].Msg() {
+			j++
+		}
+
+		p := make(wire.DropReq, wire.DropReq{}.MinSize())
+
+		wire.Packet(p).SetControlType(wire.DropReqType, 0)
+
+		p.SetMsg(d[i].Msg())
+		p.SetFirst(d[i].Seq())
+		p.SetLast(d[j-1].Seq())
+
+		tlog.V("drop").Printw("send drop request", "msg", p.Msg(), "first", tlog.Hex(p.First()), "last", tlog.Hex(p.Last()))
+
+		err = c.sendControl(wire.Packet(p))
+		if err != nil {
+			return err
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+func (c *Conn) keepalive(now int64) (err error) {
+	if now-atomic.LoadInt64(&c.lastSent) < int64(keepaliveInterval) {
+		return nil
+	}
+
+	p := c.pool.get(wire.Packet{}.MinSize())
+	defer c.pool.put(p)
+
+	p.SetControlType(wire.KeepAliveType, 0)
+
+	return c.sendControl(p)
+}
+
+// fail stops the connection and wakes up readers and writers with err.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.mu.Unlock()
+
+	c.stop()
+
+	notify(c.readnotify)
+	notify(c.writenotify)
+}
+
+// shutdown stops the connection by the peer.
+func (c *Conn) shutdown() {
+	c.stop()
+
+	if c.l != nil {
+		c.l.forget(c)
+	}
+
+	c.mu.Lock()
+
+	c.r.insert(nil)
+
+	if c.err == nil {
+		c.err = ErrPeerClosed
+	}
+
+	c.mu.Unlock()
+
+	notify(c.readnotify)
+	notify(c.writenotify)
+}
+
+func (c *Conn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.stopc:
+	default:
+		close(c.stopc)
+	}
+}
+
+func (c *Conn) sendData(p wire.DataPacket) (err error) {
+	now := low.Monotonic()
+	atomic.StoreInt64(&c.lastSent, now)
+
+	wire.Packet(p).SetTimestamp(now - c.epoch)
+	wire.Packet(p).SetSocketID(c.remoteid)
+
+	c.s.ts.Update(wire.Packet(p).RawTimestamp())
+
+	_, err = c.p.WriteTo(p, c.addr)
+
+	return errors.Wrap(err, "write")
+}
+
+// flush sends pending data packets.
+func (c *Conn) flush() (err error) {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	defer func() {
+		for i := range c.pending {
+			c.pending[i] = nil
+		}
+
+		c.pending = c.pending[:0]
+	}()
+
+	for _, p := range c.pending {
+		c.cc.sent(len(p))
+	}
+
+	c.cc.reserve(low.Monotonic(), len(c.pending))
+
+	s, ok := c.p.(sender)
+	if !ok || len(c.pending) == 1 {
+		for _, p := range c.pending {
+			err = c.sendData(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	now := low.Monotonic()
+	atomic.StoreInt64(&c.lastSent, now)
+
+	for _, p := range c.pending {
+		wire.Packet(p).SetTimestamp(now - c.epoch)
+		wire.Packet(p).SetSocketID(c.remoteid)
+
+		c.s.ts.Update(wire.Packet(p).RawTimestamp())
+	}
+
+	err = s.writeBatch(c.pending, c.addr)
+
+	return errors.Wrap(err, "write batch")
+}
+
+func (c *Conn) sendControl(p wire.Packet) (err error) {
+	now := low.Monotonic()
+	atomic.StoreInt64(&c.lastSent, now)
+
+	p.SetTimestamp(now - c.epoch)
+	p.SetSocketID(c.remoteid)
+
+	_, err = c.p.WriteTo(p, c.addr)
+
+	return errors.Wrap(err, "write")
+}
+
+// Close waits up to linger period for sent data to be acknowledged
+// and shuts down the connection.
+// Blocked and following Read and Write calls return net.ErrClosed.
+func (c *Conn) Close() (err error) {
+	return c.close(c.linger)
+}
+
+func (c *Conn) close(linger time.Duration) (err error) {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+
+		return net.ErrClosed
+	}
+
+	c.closed = true
+
+	c.mu.Unlock()
+
+	if linger != 0 {
+		c.drain(time.Now().Add(linger))
+	}
+
+	return c.abort(net.ErrClosed)
+}
+
+// abort fails the connection with reason, deregisters it and notifies the peer.
+func (c *Conn) abort(reason error) (err error) {
+	c.fail(reason)
+
+	if c.l != nil {
+		c.l.forget(c)
+	}
+
+	p := make(wire.Packet, wire.Packet{}.MinSize())
+
+	p.SetControlType(wire.ShutdownType, 0)
+
+	err = c.sendControl(p)
+	if err != nil {
+		return errors.Wrap(err, "send shutdown packet")
+	}
+
+	return nil
+}
+
+// drain waits until all sent data is acknowledged.
+func (c *Conn) drain(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.s.q) != 0 && c.err == nil {
+		select {
+		case <-c.stopc:
+			return
+		default:
+		}
+
+		c.mu.Unlock()
+		err := wait(c.writenotify, 0, deadline)
+		c.mu.Lock()
+
+		if err != nil {
+			tlog.Printw("linger expired", "local_sid", tlog.Hex(c.localid), "unacked", len(c.s.q))
+
+			return
+		}
+	}
+}
@@ -0,0 +1,649 @@
+package srt
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nikandfor/srt/wire"
+)
+
+func TestConnWrite(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:        &pc,
+		addr:     testAddr("a"),
+		remoteid: 0x1234,
+		mtu:      mtuHeaders + 10,
+	}
+
+	c.s.seq = 99
+
+	n, err := c.Write([]byte("0123456789abcdefghij_"))
+	assert.NoError(t, err)
+	assert.Equal(t, 21, n)
+
+	if !assert.Len(t, pc.w, 3) {
+		return
+	}
+
+	for i, tp := range pc.w {
+		p := wire.DataPacket(tp.p)
+
+		assert.False(t, tp.p.Control())
+		assert.EqualValues(t, 0x1234, tp.p.SocketID())
+		assert.EqualValues(t, 100+i, p.Seq())
+		assert.EqualValues(t, 1, p.Msg())
+		assert.Equal(t, i == 0, p.First(), "first %d", i)
+		assert.Equal(t, i == 2, p.Last(), "last %d", i)
+		assert.True(t, p.Ordered())
+	}
+
+	assert.Equal(t, "0123456789", string(wire.DataPacket(pc.w[0].p).Data()))
+	assert.Equal(t, "abcdefghij", string(wire.DataPacket(pc.w[1].p).Data()))
+	assert.Equal(t, "_", string(wire.DataPacket(pc.w[2].p).Data()))
+
+	_, err = c.Write([]byte("x"))
+	assert.NoError(t, err)
+
+	p := wire.DataPacket(pc.w[3].p)
+	assert.EqualValues(t, 2, p.Msg())
+	assert.True(t, p.First() && p.Last())
+}
+
+func TestConnRetransmit(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:           &pc,
+		addr:        testAddr("a"),
+		mtu:         mtuHeaders + 4,
+		writenotify: make(chan struct{}, 1),
+	}
+
+	c.s.seq = 99
+
+	_, err := c.Write([]byte("aaaabbbbccccdddd"))
+	assert.NoError(t, err)
+	assert.Len(t, c.s.q, 4)
+
+	nak := make(wire.Packet, wire.Packet{}.MinSize()+12)
+	nak.SetControlType(wire.NakType, 0)
+	copy(nak[16:], []byte{0x80, 0, 0, 101, 0, 0, 0, 102, 0, 0, 0, 103})
+
+	err = c.recv(nak, testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	if assert.Len(t, pc.w, 7) {
+		for i, seq := range []uint32{101, 102, 103} {
+			p := wire.DataPacket(pc.w[4+i].p)
+
+			assert.Equal(t, seq, p.Seq())
+			assert.True(t, p.Retransmitted())
+		}
+	}
+
+	ack := make(wire.Packet, wire.Ack{}.MinSize())
+	ack.SetControlType(wire.AckType, 0)
+	wire.Ack(ack).SetSeq(102)
+
+	err = c.recv(ack, testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	if assert.Len(t, c.s.q, 2) {
+		assert.EqualValues(t, 102, c.s.q[0].Seq())
+	}
+
+	sent := c.epoch + c.s.timestamp(c.s.q[0])
+
+	err = c.recv(ack, testAddr("a"), sent+int64(synInterval)/2)
+	assert.NoError(t, err, "duplicate ack")
+
+	c.resendUnacked(sent + int64(synInterval) - 1)
+
+	err = c.sendLost(sent + int64(synInterval) - 1)
+	assert.NoError(t, err)
+	assert.Len(t, pc.w, 7)
+
+	c.resendUnacked(sent + int64(synInterval))
+
+	err = c.sendLost(sent + int64(synInterval))
+	assert.NoError(t, err)
+
+	if assert.Len(t, pc.w, 9) {
+		for i, seq := range []uint32{102, 103} {
+			p := wire.DataPacket(pc.w[7+i].p)
+
+			assert.Equal(t, seq, p.Seq())
+			assert.True(t, p.Retransmitted())
+		}
+	}
+}
+
+func TestConnSendLostPaced(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:    &pc,
+		addr: testAddr("a"),
+	}
+
+	for seq := uint32(100); seq < 104; seq++ {
+		p := make(wire.DataPacket, 1000-ipUDPHeaders)
+		p.SetSeq(seq)
+
+		c.s.push(p)
+	}
+
+	now := int64(10 * time.Second)
+
+	c.cc = liveCC{
+		live:     true,
+		maxbw:    1_000_000,
+		overhead: 25,
+		size:     1000,
+		period:   int64(time.Millisecond),
+		next:     now,
+		budget:   10_000,
+	}
+
+	c.sloss.add(100, 103, 0)
+
+	for _, x := range []struct {
+		now  time.Duration
+		sent int
+	}{
+		{0, 1},
+		{time.Millisecond / 2, 1},
+		{time.Millisecond, 2},
+		{3 * time.Millisecond, 4},
+	} {
+		err := c.sendLost(now + int64(x.now))
+		assert.NoError(t, err)
+		assert.Len(t, pc.w, x.sent, "at %v", x.now)
+	}
+
+	assert.Len(t, c.sloss.l, 0)
+
+	for i, w := range pc.w {
+		p := wire.DataPacket(w.p)
+
+		assert.EqualValues(t, 100+i, p.Seq())
+		assert.True(t, p.Retransmitted())
+	}
+}
+
+func TestConnFileCongestion(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	l.Congestion = "file"
+
+	now := int64(time.Second)
+
+	c := l.newConn(testAddr("a"), &conndata{lseq: 100, mtu: 1500, window: 0x2000}, now)
+
+	for i := 0; i < 20; i++ {
+		c.cc.input(1000, now+int64(i)*int64(100*time.Millisecond))
+		c.cc.sent(1000)
+	}
+
+	now += int64(2 * time.Second)
+
+	assert.EqualValues(t, 0, c.cc.period, "not paced")
+
+	for seq := uint32(100); seq < 104; seq++ {
+		p := make(wire.DataPacket, 1000-ipUDPHeaders)
+		p.SetSeq(seq)
+
+		c.s.push(p)
+	}
+
+	c.sloss.add(100, 103, 0)
+
+	err := c.sendLost(now)
+	assert.NoError(t, err)
+	assert.Len(t, pc.w, 4, "all retransmitted")
+	assert.Zero(t, c.stats.SendSkipped)
+}
+
+func TestConnShortKeyMaterial(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:    &pc,
+		addr: testAddr("a"),
+	}
+
+	for _, sub := range []uint16{wire.KMReqExt, wire.KMRspExt} {
+		p := make(wire.Packet, wire.Packet{}.MinSize())
+		p.SetControlType(wire.UserDefinedType, sub)
+
+		err := c.recv(p, testAddr("a"), 0)
+		assert.Error(t, err, "sub %d", sub)
+	}
+
+	assert.Len(t, pc.w, 0)
+}
+
+func TestConnPlaintextOnEncrypted(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	l.Passphrase = "secret"
+
+	c := l.newConn(testAddr("a"), &conndata{rseq: 99, mtu: 1500, window: 0x2000}, 0)
+
+	p := make(wire.DataPacket, 16+5)
+	p.SetSeq(100)
+	p.SetSingle(true)
+	copy(p.Data(), "EVIL!")
+
+	err := c.recv(wire.Packet(p), testAddr("a"), 0)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, c.stats.RecvUndecrypted)
+	assert.Equal(t, 0, c.r.n)
+}
+
+func TestConnNak(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:          &pc,
+		addr:       testAddr("a"),
+		mtu:        1500,
+		readnotify: make(chan struct{}, 1),
+	}
+
+	c.r.seq = 99
+	c.last = 99
+
+	data := func(seq uint32) wire.Packet {
+		p := make(wire.DataPacket, 20)
+		p.SetSeq(seq)
+		p.SetSingle(true)
+
+		return wire.Packet(p)
+	}
+
+	naks := func() (r [][2]uint32) {
+		for _, w := range pc.w {
+			if tp, _ := w.p.ControlType(); !w.p.Control() || tp != wire.NakType {
+				continue
+			}
+
+			p := wire.Nak(w.p)
+
+			for st := p.LossStart(); st < len(p); {
+				from, to, next := p.Loss(st)
+				r = append(r, [2]uint32{from, to})
+				st = next
+			}
+		}
+
+		pc.w = pc.w[:0]
+
+		return
+	}
+
+	for _, seq := range []uint32{100, 103, 105} {
+		err := c.recv(data(seq), testAddr("a"), 0)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, [][2]uint32{{101, 102}, {104, 104}}, naks())
+
+	err := c.recv(data(101), testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	err = c.timers(int64(nakInterval) - 1)
+	assert.NoError(t, err)
+	assert.Len(t, naks(), 0)
+
+	err = c.timers(int64(nakInterval))
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]uint32{{102, 102}, {104, 104}}, naks())
+
+	drop := make(wire.DropReq, wire.DropReq{}.MinSize())
+	wire.Packet(drop).SetControlType(wire.DropReqType, 0)
+	drop.SetFirst(102)
+	drop.SetLast(110)
+
+	err = c.recv(wire.Packet(drop), testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	err = c.recv(data(111), testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	err = c.timers(3 * int64(nakInterval))
+	assert.NoError(t, err)
+	assert.Len(t, naks(), 0, "dropped beyond the last received")
+	assert.Len(t, c.loss.l, 0)
+}
+
+func TestConnFullAck(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var rpc, spc testPacketConn
+
+	r := &Conn{
+		p:          &rpc,
+		addr:       testAddr("s"),
+		mtu:        1500,
+		bufsize:    100,
+		rtt:        int64(defaultRTT),
+		rttVar:     int64(defaultRTT / 2),
+		readnotify: make(chan struct{}, 1),
+	}
+
+	r.r.seq = 99
+	r.last = 99
+
+	s := &Conn{
+		p:           &spc,
+		addr:        testAddr("r"),
+		mtu:         1500,
+		writenotify: make(chan struct{}, 1),
+	}
+
+	s.s.seq = 99
+
+	_, err := s.Write([]byte("message"))
+	assert.NoError(t, err)
+
+	err = r.recv(spc.w[0].p, testAddr("s"), 0)
+	assert.NoError(t, err)
+
+	err = r.timers(int64(time.Second))
+	assert.NoError(t, err)
+
+	if !assert.Len(t, rpc.w, 1) {
+		return
+	}
+
+	ack := wire.Ack(rpc.w[0].p)
+
+	assert.True(t, ack.Full())
+	assert.EqualValues(t, 1, ack.AckNum())
+	assert.EqualValues(t, 101, ack.Seq())
+	assert.Equal(t, defaultRTT, ack.RTT())
+	assert.Equal(t, 99, ack.Buffer())
+
+	err = s.recv(wire.Packet(ack), testAddr("r"), 0)
+	assert.NoError(t, err)
+	assert.Len(t, s.s.q, 0)
+
+	if !assert.Len(t, spc.w, 2) {
+		return
+	}
+
+	ackack := spc.w[1].p
+
+	tp, _ := ackack.ControlType()
+	assert.EqualValues(t, wire.AckAckType, tp)
+	assert.EqualValues(t, 1, ackack.TypeSpecific())
+
+	err = r.recv(ackack, testAddr("s"), int64(time.Second+20*time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.Equal(t, (7*int64(defaultRTT)+int64(20*time.Millisecond))/8, r.rtt)
+
+	err = r.timers(int64(time.Second + 30*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Len(t, rpc.w, 1, "nothing new to ack")
+}
+
+func TestConnPeerIdle(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+	defer l.Close()
+
+	c := &Conn{
+		l:       l,
+		p:       &pc,
+		addr:    testAddr("a"),
+		localid: 1,
+		idle:    int64(time.Second),
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+		stopc:       make(chan struct{}),
+	}
+
+	now := low.Monotonic()
+
+	err := c.keepalive(now)
+	assert.NoError(t, err)
+	assert.Len(t, pc.w, 1)
+
+	err = c.keepalive(now)
+	assert.NoError(t, err)
+	assert.Len(t, pc.w, 1, "keepalive is sent only when idle")
+
+	if tp, _ := pc.w[0].p.ControlType(); !assert.EqualValues(t, wire.KeepAliveType, tp) {
+		return
+	}
+
+	l.register(c)
+	l.acceptc <- c
+
+	c.lastRecv = now
+
+	err = c.timers(now + int64(2*time.Second))
+	assert.NoError(t, err)
+
+	assert.Len(t, l.socks, 0)
+
+	if assert.Len(t, pc.w, 2) {
+		tp, _ := pc.w[1].p.ControlType()
+		assert.EqualValues(t, wire.ShutdownType, tp)
+	}
+
+	next := &Conn{
+		l:       l,
+		p:       &pc,
+		addr:    testAddr("b"),
+		localid: 2,
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+		stopc:       make(chan struct{}),
+	}
+
+	l.register(next)
+	l.acceptc <- next
+
+	acc, err := l.Accept()
+	assert.NoError(t, err)
+	assert.True(t, acc == next, "timed out conn is not accepted")
+
+	_, err = c.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, ErrPeerIdleTimeout), "read: %v", err)
+
+	nerr, ok := err.(net.Error)
+	assert.True(t, ok && nerr.Timeout(), "timeout error")
+
+	_, err = c.Write([]byte("data"))
+	assert.True(t, errors.Is(err, ErrPeerIdleTimeout), "write: %v", err)
+}
+
+func TestConnDeadline(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:      &pc,
+		addr:   testAddr("a"),
+		mtu:    mtuHeaders + 10,
+		window: 1,
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+	}
+
+	err := c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	assert.NoError(t, err)
+
+	start := time.Now()
+
+	_, err = c.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "read: %v", err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+
+	errc := make(chan error, 1)
+
+	_ = c.SetReadDeadline(time.Time{})
+
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	_ = c.SetReadDeadline(time.Now())
+
+	err = <-errc
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "read: %v", err)
+
+	err = c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	assert.NoError(t, err)
+
+	n, err := c.Write([]byte("0123456789abc"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "write: %v", err)
+	assert.Equal(t, 10, n)
+}
+
+func TestConnClose(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	l := newListener(&pc)
+
+	c := &Conn{
+		l:      l,
+		p:      &pc,
+		addr:   testAddr("a"),
+		mtu:    mtuHeaders + 10,
+		linger: 20 * time.Millisecond,
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+		stopc:       make(chan struct{}),
+	}
+
+	l.register(c)
+
+	c.r.window = 16
+
+	dp := make(wire.DataPacket, 16+4)
+	dp.SetSeq(1)
+	dp.SetSingle(true)
+	c.r.insert(dp)
+
+	_, err := c.Write([]byte("data"))
+	assert.NoError(t, err)
+
+	start := time.Now()
+
+	err = c.Close()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond), "linger")
+
+	assert.Len(t, l.socks, 0)
+
+	if assert.Len(t, pc.w, 2) {
+		tp, _ := pc.w[1].p.ControlType()
+		assert.EqualValues(t, wire.ShutdownType, tp)
+	}
+
+	err = c.Close()
+	assert.True(t, errors.Is(err, net.ErrClosed), "second close: %v", err)
+
+	_, err = c.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, net.ErrClosed), "read: %v", err)
+
+	_, err = c.Write([]byte("data"))
+	assert.True(t, errors.Is(err, net.ErrClosed), "write: %v", err)
+}
+
+func TestConnPeerShutdown(t *testing.T) {
+	tlog.DefaultLogger = tlog.NewTestLogger(t, "", nil)
+
+	var pc testPacketConn
+
+	c := &Conn{
+		p:      &pc,
+		addr:   testAddr("a"),
+		mtu:    mtuHeaders + 10,
+		window: 1,
+
+		readnotify:  make(chan struct{}, 1),
+		writenotify: make(chan struct{}, 1),
+		stopc:       make(chan struct{}),
+	}
+
+	c.r.window = 16
+
+	dp := make(wire.DataPacket, 16+8)
+	dp.SetSeq(1)
+	dp.SetSingle(true)
+	copy(dp.Data(), "buffered")
+	c.r.insert(dp)
+
+	_, err := c.Write([]byte("data"))
+	assert.NoError(t, err)
+
+	p := make(wire.Packet, wire.Packet{}.MinSize())
+	p.SetControlType(wire.ShutdownType, 0)
+
+	err = c.recv(p, testAddr("a"), 0)
+	assert.NoError(t, err)
+
+	err = c.SetWriteDeadline(time.Now().Add(time.Second))
+	assert.NoError(t, err)
+
+	_, err = c.Write([]byte("data"))
+	assert.True(t, errors.Is(err, ErrPeerClosed), "write: %v", err)
+
+	buf := make([]byte, 10)
+
+	n, err := c.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "buffered", string(buf[:n]))
+
+	_, err = c.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
@@ -1,19 +1,102 @@
 package wire
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"time"
+)
 
 type (
 	Ack []byte
 )
 
+const (
+	lightAckSize = headerSize + 4
+	smallAckSize = headerSize + 16
+	fullAckSize  = headerSize + 28
+)
+
 func (p Ack) MinSize() int {
-	return headerSize + 4
+	return lightAckSize
+}
+
+func (p Ack) FullSize() int {
+	return fullAckSize
 }
 
+func (p Ack) Light() bool {
+	return len(p) < smallAckSize
+}
+
+func (p Ack) Full() bool {
+	return len(p) >= fullAckSize
+}
+
+// AckNum is acknowledgement number which is returned back in AckAck. Zero for light acks.
 func (p Ack) AckNum() uint32 {
 	return binary.BigEndian.Uint32(p[4:])
 }
 
+// Seq is the sequence number of the next expected packet.
+func (p Ack) Seq() uint32 {
+	return binary.BigEndian.Uint32(p[headerSize:]) & 0x7fff_ffff
+}
+
+func (p Ack) RTT() time.Duration {
+	return time.Duration(binary.BigEndian.Uint32(p[headerSize+4:])) * time.Microsecond
+}
+
+func (p Ack) RTTVar() time.Duration {
+	return time.Duration(binary.BigEndian.Uint32(p[headerSize+8:])) * time.Microsecond
+}
+
+// Buffer is available receiver buffer size in packets.
+func (p Ack) Buffer() int {
+	return int(binary.BigEndian.Uint32(p[headerSize+12:]))
+}
+
+// PacketRecvRate is in packets per second.
+func (p Ack) PacketRecvRate() int {
+	return int(binary.BigEndian.Uint32(p[headerSize+16:]))
+}
+
+// LinkCapacity is in packets per second.
+func (p Ack) LinkCapacity() int {
+	return int(binary.BigEndian.Uint32(p[headerSize+20:]))
+}
+
+// RecvRate is in bytes per second.
+func (p Ack) RecvRate() int {
+	return int(binary.BigEndian.Uint32(p[headerSize+24:]))
+}
+
 func (p Ack) SetAckNum(n uint32) {
-	binary.BigEndian.PutUint32(p[headerSize:], n)
+	binary.BigEndian.PutUint32(p[4:], n)
+}
+
+func (p Ack) SetSeq(seq uint32) {
+	binary.BigEndian.PutUint32(p[headerSize:], seq&0x7fff_ffff)
+}
+
+func (p Ack) SetRTT(d time.Duration) {
+	binary.BigEndian.PutUint32(p[headerSize+4:], uint32(d/time.Microsecond))
+}
+
+func (p Ack) SetRTTVar(d time.Duration) {
+	binary.BigEndian.PutUint32(p[headerSize+8:], uint32(d/time.Microsecond))
+}
+
+func (p Ack) SetBuffer(n int) {
+	binary.BigEndian.PutUint32(p[headerSize+12:], uint32(n))
+}
+
+func (p Ack) SetPacketRecvRate(n int) {
+	binary.BigEndian.PutUint32(p[headerSize+16:], uint32(n))
+}
+
+func (p Ack) SetLinkCapacity(n int) {
+	binary.BigEndian.PutUint32(p[headerSize+20:], uint32(n))
+}
+
+func (p Ack) SetRecvRate(n int) {
+	binary.BigEndian.PutUint32(p[headerSize+24:], uint32(n))
 }
@@ -51,6 +51,11 @@ func (p DataPacket) SetSeq(seq uint32) {
 	binary.BigEndian.PutUint32(p, seq&0x7fff_ffff)
 }
 
+func (p DataPacket) SetMsg(msg uint32) {
+	v := binary.BigEndian.Uint32(p[4:])&^0x3ff_ffff | msg&0x3ff_ffff
+	binary.BigEndian.PutUint32(p[4:], v)
+}
+
 func (p DataPacket) SetFirst(f bool) {
 	if f {
 		p[4] |= 0b1000_0000
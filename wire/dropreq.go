@@ -0,0 +1,35 @@
+package wire
+
+import "encoding/binary"
+
+type (
+	DropReq []byte
+)
+
+func (p DropReq) MinSize() int {
+	return headerSize + 8
+}
+
+func (p DropReq) Msg() uint32 {
+	return binary.BigEndian.Uint32(p[4:]) & 0x3ff_ffff
+}
+
+func (p DropReq) First() uint32 {
+	return binary.BigEndian.Uint32(p[headerSize:]) & 0x7fff_ffff
+}
+
+func (p DropReq) Last() uint32 {
+	return binary.BigEndian.Uint32(p[headerSize+4:]) & 0x7fff_ffff
+}
+
+func (p DropReq) SetMsg(msg uint32) {
+	binary.BigEndian.PutUint32(p[4:], msg&0x3ff_ffff)
+}
+
+func (p DropReq) SetFirst(seq uint32) {
+	binary.BigEndian.PutUint32(p[headerSize:], seq&0x7fff_ffff)
+}
+
+func (p DropReq) SetLast(seq uint32) {
+	binary.BigEndian.PutUint32(p[headerSize+4:], seq&0x7fff_ffff)
+}
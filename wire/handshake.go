@@ -24,17 +24,71 @@ const (
 	Conclusion = 0xffffffff
 )
 
+// RejectionBase is added to rejection reason in handshake Type field.
+const RejectionBase = 1000
+
+// Rejection reasons.
+const (
+	RejUnknown = iota
+	RejSystem
+	RejPeer
+	RejResource
+	RejRogue
+	RejBacklog
+	RejInternal
+	RejClose
+	RejVersion
+	RejRendezvousCookie
+	RejBadSecret
+	RejUnsecure
+	RejMessageAPI
+	RejCongestion
+	RejFilter
+	RejGroup
+	RejTimeout
+	RejCrypto
+)
+
 // Encryption schemes.
 const (
-	NoEncryption = iota
-	AES128
-	AES192
-	AES256
+	NoEncryption = 0
+	AES128       = 2
+	AES192       = 3
+	AES256       = 4
 )
 
 // Magic extension field value for SRT protocol.
 const Magic = 0x4a17
 
+// Handshake Extensions field flags.
+const (
+	ExtFieldHSReq = 1 << iota
+	ExtFieldKMReq
+	ExtFieldConfig
+)
+
+// Handshake extension types.
+const (
+	HSReqExt = 1 + iota
+	HSRspExt
+	KMReqExt
+	KMRspExt
+	StreamIDExt
+	CongestionExt
+)
+
+// HandshakeExt flags.
+const (
+	FlagTSBPDSend = 1 << iota
+	FlagTSBPDRecv
+	FlagCrypt
+	FlagTLPktDrop
+	FlagPeriodicNak
+	FlagRexmit
+	FlagStream
+	FlagPacketFilter
+)
+
 func (p Handshake) MinSize() int {
 	return handshakeSize
 }
@@ -131,12 +185,40 @@ func (p Handshake) SetCookie(c uint32) {
 	binary.BigEndian.PutUint32(p[headerSize+28:], c)
 }
 
+func MakeExt(tp int, data []byte) (e Ext) {
+	size := (len(data) + 3) &^ 3
+
+	e = make(Ext, 4+size)
+	e.SetHeader(tp, len(e))
+
+	copy(e[4:], data)
+
+	return e
+}
+
 func (p Ext) SetHeader(tp, size int) {
 	binary.BigEndian.PutUint32(p, uint32(tp<<16)|uint32(uint16(size/4-1)))
 }
 
 func (p HandshakeExt) Size() int { return 16 }
 
+func (p HandshakeExt) Version() (major, minor, patch int) {
+	v := binary.BigEndian.Uint32(p[4:])
+
+	return int(v >> 16), int(v >> 8 & 0xff), int(v & 0xff)
+}
+
+func (p HandshakeExt) Flags() uint32 {
+	return binary.BigEndian.Uint32(p[8:])
+}
+
+func (p HandshakeExt) TSBPDDelays() (recv, send int64) {
+	recv = int64(binary.BigEndian.Uint16(p[12:])) * int64(time.Millisecond)
+	send = int64(binary.BigEndian.Uint16(p[14:])) * int64(time.Millisecond)
+
+	return
+}
+
 func (p HandshakeExt) SetVersion(major, minor, patch int) {
 	binary.BigEndian.PutUint32(p[4:], uint32(major<<16)|uint32(uint16(minor<<8))|uint32(uint16(patch)))
 }
@@ -151,12 +233,35 @@ func (p HandshakeExt) SetTSBPDDelays(recv, send int64) {
 }
 
 func MakeCongestionControlExt(s string) (e []byte) {
-	e = make([]byte, 4+len(s))
-	e[1] = 6
+	return MakeStringExt(CongestionExt, s)
+}
 
-	binary.BigEndian.PutUint16(e[2:], uint16(len(s)/4))
+// MakeStringExt encodes string extension such as StreamID or Congestion.
+// String is zero padded and each 4 bytes word is reversed.
+func MakeStringExt(tp int, s string) (e Ext) {
+	e = MakeExt(tp, []byte(s))
 
-	copy(e[4:], s)
+	swapWords(e[4:])
 
 	return e
 }
+
+// ExtString decodes string extension data without header.
+func ExtString(data []byte) string {
+	b := make([]byte, len(data))
+	copy(b, data)
+
+	swapWords(b)
+
+	for len(b) != 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+
+	return string(b)
+}
+
+func swapWords(b []byte) {
+	for i := 0; i+4 <= len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+}
@@ -0,0 +1,139 @@
+package wire
+
+import "encoding/binary"
+
+type (
+	// KeyMaterial is KMREQ/KMRSP message.
+	// It's sent as a handshake extension or as a UserDefined control packet body.
+	KeyMaterial []byte
+)
+
+const kmHeaderSize = 16
+
+const kmSign = 0x2029
+
+// Cipher modes.
+const (
+	CipherNone = iota
+	CipherECB
+	CipherCTR
+	CipherCBC
+	CipherGCM
+)
+
+// Key slots.
+const (
+	KeyEven = 1 << iota
+	KeyOdd
+)
+
+const (
+	kmVersion    = 1
+	kmPacketType = 2
+	kmStreamSRT  = 2
+	kmWrapICV    = 8
+)
+
+// KeyLen returns key length in bytes for handshake Encryption field value.
+func KeyLen(enc uint16) int {
+	switch enc {
+	case AES128:
+		return 16
+	case AES192:
+		return 24
+	case AES256:
+		return 32
+	}
+
+	return 0
+}
+
+// EncryptionByKeyLen is the reverse of KeyLen.
+func EncryptionByKeyLen(n int) uint16 {
+	switch n {
+	case 16:
+		return AES128
+	case 24:
+		return AES192
+	case 32:
+		return AES256
+	}
+
+	return NoEncryption
+}
+
+func MakeKeyMaterial(cipher, keys int, salt, wrapped []byte) (p KeyMaterial) {
+	p = make(KeyMaterial, kmHeaderSize+len(salt)+len(wrapped))
+
+	p[0] = kmVersion<<4 | kmPacketType
+	binary.BigEndian.PutUint16(p[1:], kmSign)
+	p[3] = byte(keys & 0b11)
+
+	p[8] = byte(cipher)
+
+	if cipher == CipherGCM {
+		p[9] = 1 // AES-GCM auth
+	}
+	p[10] = kmStreamSRT
+
+	p[14] = byte(len(salt) / 4)
+	p[15] = byte((len(wrapped) - kmWrapICV) / nkeys(keys) / 4)
+
+	copy(p[kmHeaderSize:], salt)
+	copy(p[kmHeaderSize+len(salt):], wrapped)
+
+	return p
+}
+
+func (p KeyMaterial) MinSize() int {
+	return kmHeaderSize
+}
+
+func (p KeyMaterial) Valid() bool {
+	if len(p) < kmHeaderSize || p[0] != kmVersion<<4|kmPacketType || binary.BigEndian.Uint16(p[1:]) != kmSign {
+		return false
+	}
+
+	k := nkeys(p.Keys())
+
+	return k != 0 && len(p) == kmHeaderSize+p.SaltLen()+kmWrapICV+k*p.KeyLen()
+}
+
+func (p KeyMaterial) Keys() int {
+	return int(p[3] & 0b11)
+}
+
+func (p KeyMaterial) Cipher() int {
+	return int(p[8])
+}
+
+func (p KeyMaterial) Auth() int {
+	return int(p[9])
+}
+
+func (p KeyMaterial) SaltLen() int {
+	return int(p[14]) * 4
+}
+
+func (p KeyMaterial) KeyLen() int {
+	return int(p[15]) * 4
+}
+
+func (p KeyMaterial) Salt() []byte {
+	return p[kmHeaderSize : kmHeaderSize+p.SaltLen()]
+}
+
+func (p KeyMaterial) Wrapped() []byte {
+	return p[kmHeaderSize+p.SaltLen():]
+}
+
+func nkeys(keys int) int {
+	switch keys & 0b11 {
+	case KeyEven, KeyOdd:
+		return 1
+	case KeyEven | KeyOdd:
+		return 2
+	}
+
+	return 0
+}
@@ -0,0 +1,52 @@
+package wire
+
+import "encoding/binary"
+
+type (
+	Nak []byte
+)
+
+const lossRangeFlag = 0x8000_0000
+
+func (p Nak) MinSize() int {
+	return headerSize + 4
+}
+
+func (p Nak) LossStart() int {
+	return headerSize
+}
+
+// Loss decodes loss list entry at st.
+// Single lost packet is returned as from == to.
+// next is -1 if entry is truncated.
+func (p Nak) Loss(st int) (from, to uint32, next int) {
+	if st+4 > len(p) {
+		return 0, 0, -1
+	}
+
+	from = binary.BigEndian.Uint32(p[st:])
+
+	if from&lossRangeFlag == 0 {
+		return from, from, st + 4
+	}
+
+	if st+8 > len(p) {
+		return 0, 0, -1
+	}
+
+	from &^= lossRangeFlag
+	to = binary.BigEndian.Uint32(p[st+4:]) &^ lossRangeFlag
+
+	return from, to, st + 8
+}
+
+// AppendLoss encodes loss list entry.
+func AppendLoss(b []byte, from, to uint32) []byte {
+	if from == to {
+		return append(b, byte(from>>24)&0x7f, byte(from>>16), byte(from>>8), byte(from))
+	}
+
+	return append(b,
+		byte(from>>24)|0x80, byte(from>>16), byte(from>>8), byte(from),
+		byte(to>>24)&0x7f, byte(to>>16), byte(to>>8), byte(to))
+}
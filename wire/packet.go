@@ -25,7 +25,8 @@ const (
 	AckAckType
 	DropReqType
 	PeerErrorType
-	UserDefinedType
+
+	UserDefinedType = 0x7fff // subtype is one of handshake extension types
 )
 
 var handshakeHeader = [8]byte{controlPacket}
@@ -53,7 +54,12 @@ func (p Packet) TypeSpecific() uint32 {
 }
 
 func (p Packet) Timestamp() int64 {
-	return int64(binary.BigEndian.Uint32(p[8:]) * 1000)
+	return int64(binary.BigEndian.Uint32(p[8:])) * 1000
+}
+
+// RawTimestamp returns timestamp field in microseconds as is.
+func (p Packet) RawTimestamp() uint32 {
+	return binary.BigEndian.Uint32(p[8:])
 }
 
 func (p Packet) SocketID() uint32 {